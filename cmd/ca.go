@@ -0,0 +1,177 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charles-d-burton/hansel/keys"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+const (
+	caKeyFile = "/etc/hansel/ca"
+	caPubFile = "/etc/hansel/ca.pub"
+)
+
+var (
+	caPublicKey    string
+	certPrincipals []string
+	certID         string
+	certValidFor   time.Duration
+	userCA         ssh.PublicKey
+)
+
+// caCmd represents the ca command
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the certificate authority for minions",
+	Long: `Minions presenting a certificate signed by the CA with a principal matching
+their minion ID are admitted by the server without being accepted by hand.`,
+}
+
+var caInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate the CA key pair",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := initCA()
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var caSignCmd = &cobra.Command{
+	Use:   "sign <public key file>",
+	Short: "Sign a minion public key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := signCert(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caInitCmd, caSignCmd)
+	caSignCmd.Flags().StringSliceVarP(&certPrincipals, "principal", "n", nil, "Minion ID the certificate is valid for (required)")
+	caSignCmd.Flags().StringVarP(&certID, "id", "I", "", "Key identity recorded in the certificate")
+	caSignCmd.Flags().DurationVarP(&certValidFor, "valid-for", "V", 365*24*time.Hour, "How long the certificate is valid, 0 never expires")
+	caSignCmd.MarkFlagRequired("principal")
+	serveCmd.Flags().StringVar(&caPublicKey, "ca-public-key", caPubFile, "Admit minions with certificates signed by this CA")
+}
+
+//Generate the CA keys, encrypted like any other key when a passphrase is configured
+func initCA() error {
+	if _, err := os.Stat(keyDir); os.IsNotExist(err) {
+		os.Mkdir(keyDir, os.FileMode(0700))
+	}
+	kt, err := keys.ParseKeyType(viper.GetString("key-type"))
+	if err != nil {
+		return err
+	}
+	passphrase, err := keyUnlocker().Passphrase()
+	if err != nil {
+		return err
+	}
+	if err := keys.MakeSSHKeyPair(caPubFile, caKeyFile, kt, passphrase); err != nil {
+		return err
+	}
+	pub, err := keys.ReadPublicKey(caPubFile)
+	if err != nil {
+		return err
+	}
+	fmt.Println("CA key:", caPubFile, ssh.FingerprintSHA256(pub))
+	return nil
+}
+
+//Sign a public key and write the certificate next to it the way ssh-keygen does
+func signCert(pubFile string) error {
+	ca, err := keyUnlocker().Signer(caKeyFile)
+	if err != nil {
+		return err
+	}
+	pub, err := keys.ReadPublicKey(pubFile)
+	if err != nil {
+		return err
+	}
+	id := certID
+	if id == "" {
+		id = certPrincipals[0]
+	}
+	cert, err := keys.SignUserCert(ca, pub, id, certPrincipals, certValidFor)
+	if err != nil {
+		return err
+	}
+	certFile := strings.TrimSuffix(pubFile, ".pub") + "-cert.pub"
+	if err := ioutil.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		return err
+	}
+	fmt.Println("Signed", filepath.Base(pubFile), "for", strings.Join(certPrincipals, ","), "written to", certFile)
+	return nil
+}
+
+//Load the CA public key the server trusts, missing is fine and just disables certificates
+func loadUserCA(file string) error {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+	pub, err := keys.ReadPublicKey(file)
+	if err != nil {
+		return err
+	}
+	log.Println("Trusting certificates signed by ", file, ssh.FingerprintSHA256(pub))
+	userCA = pub
+	return nil
+}
+
+//Admit a minion presenting a certificate signed by the trusted CA for its name
+func validateCert(connMeta ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if userCA == nil {
+		return nil, errors.New("Certificates are not trusted")
+	}
+	sha := ssh.FingerprintSHA256(cert.Key)
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), userCA.Marshal())
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return isKeyRevoked(sha)
+		},
+	}
+	if _, err := checker.Authenticate(connMeta, cert); err != nil {
+		log.Println("Refusing certificate for ", connMeta.User(), err)
+		return nil, err
+	}
+	log.Printf("Admitting %s with certificate %q serial %d", connMeta.User(), cert.KeyId, cert.Serial)
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"fingerprint": sha,
+			"admitted":    "ca",
+		},
+	}, nil
+}
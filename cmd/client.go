@@ -15,13 +15,13 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"fmt"
 
 	"log"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,12 +29,20 @@ import (
 	"github.com/charles-d-burton/hansel/datums"
 	"github.com/charles-d-burton/hansel/keys"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	ssh "golang.org/x/crypto/ssh"
 )
 
+const (
+	masterPinFile = "/etc/hansel/known_masters"
+)
+
 var (
-	clientHost string
-	clientPort string
+	clientHost        string
+	clientPort        string
+	masterFingerprint string
+	clientToken       string
+	clientID          string
 )
 
 type Server struct {
@@ -43,7 +51,13 @@ type Server struct {
 	Port      *string
 	Closed    bool
 	SSHConfig *ssh.ClientConfig
+	Token     string
+	Conn      ssh.Conn
 	Channel   ssh.Channel
+	//What was agreed on with the master in the hello exchange
+	Protocol *datums.HelloAck
+	//Every envelope on the channel goes through one stream
+	stream *wireStream
 }
 
 // clientCmd represents the client command
@@ -83,6 +97,12 @@ func init() {
 	// clientCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	clientCmd.Flags().StringVarP(&clientHost, "host", "h", "", "The remote host to connect to")
 	clientCmd.Flags().StringVarP(&clientPort, "port", "p", "62621", "Port of remote host")
+	clientCmd.Flags().StringVar(&masterFingerprint, "master-fingerprint", "", "Only trust a master presenting this host key fingerprint")
+	viper.BindPFlag("master-fingerprint", clientCmd.Flags().Lookup("master-fingerprint"))
+	clientCmd.Flags().StringVar(&clientToken, "token", "", "Bootstrap token to have the key authorized on first connect")
+	viper.BindPFlag("token", clientCmd.Flags().Lookup("token"))
+	clientCmd.Flags().StringVar(&clientID, "id", "", "Minion ID to use instead of the one generated on first run")
+	viper.BindPFlag("id", clientCmd.Flags().Lookup("id"))
 
 }
 
@@ -91,46 +111,133 @@ func connect(privateKey string) error {
 	if err != nil {
 		return err
 	}
-	pubkey, err := keys.PublicKeyFile(privateKey)
+	minionID, err = loadMinionID()
+	if err != nil {
+		return err
+	}
+	log.Println("Minion ID ", minionID)
+	//Fail early if the key can't be unlocked
+	_, err = keyUnlocker().Signer(privateKey)
+	if err != nil {
+		return err
+	}
+	kt, err := keys.ParseKeyType(viper.GetString("key-type"))
+	if err != nil {
+		return err
+	}
+	hostKeyAlgorithms, err := keys.PinnedHostKeyAlgorithms(masterPinFile, clientHost+":"+clientPort, kt.Algorithm())
 	if err != nil {
 		return err
 	}
 	sshConfig := &ssh.ClientConfig{
-		User: name,
-		Auth: []ssh.AuthMethod{
-			pubkey,
-		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
-		Timeout: time.Second * 30,
+		User:              minionID,
+		ClientVersion:     clientVersionPrefix + name,
+		HostKeyCallback:   keys.PinnedHostKeyCallback(masterPinFile, viper.GetString("master-fingerprint")),
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           time.Second * 30,
 	}
 	//Setup the Server
 	server := &Server{
 		Host:      &clientHost,
 		Port:      &clientPort,
 		SSHConfig: sshConfig,
+		Token:     viper.GetString("token"),
 	}
 	server.Connect()
 	return err
 }
 
+//Load the keys to offer the server, they are loaded for every connect since a rotation replaces them.
+//The next key is returned on its own if a rotation was interrupted before it was committed.
+func loadSigners(privateKey string) ([]ssh.Signer, *usedSigner, error) {
+	signer, err := keyUnlocker().Signer(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	//Offer a CA signed certificate first if there is one, the plain key is still tried if it's refused
+	signers := []ssh.Signer{signer}
+	certSigner, err := keys.CertSigner(strings.TrimSuffix(publicKey, ".pub")+"-cert.pub", signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if certSigner != nil {
+		signers = append([]ssh.Signer{certSigner}, signers...)
+	}
+	if _, err := os.Stat(keys.NextKeyFile(privateKey)); err != nil {
+		return signers, nil, nil
+	}
+	nextSigner, err := keyUnlocker().Signer(keys.NextKeyFile(privateKey))
+	if err != nil {
+		log.Println("Ignoring next key ", err)
+		return signers, nil, nil
+	}
+	next := &usedSigner{Signer: nextSigner}
+	//The master may have authorized the next key without getting to tell us
+	return append([]ssh.Signer{next}, signers...), next, nil
+}
+
+//Answer the server's keyboard-interactive prompt with the bootstrap token
+func tokenAuth(token string) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = token
+		}
+		return answers, nil
+	})
+}
+
 func (server *Server) Connect() {
 	operation := func() error {
 		log.Println("Attempting to connect")
 
-		client, err := ssh.Dial("tcp", *server.Host+":"+*server.Port, server.SSHConfig)
+		signers, next, err := loadSigners(privateKey)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		server.SSHConfig.Auth = []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+		//The token goes first so the server knows about it by the time the key is checked
+		if server.Token != "" {
+			server.SSHConfig.Auth = append([]ssh.AuthMethod{tokenAuth(server.Token)}, server.SSHConfig.Auth...)
+		}
+		addr := *server.Host + ":" + *server.Port
+		conn, err := net.DialTimeout("tcp", addr, server.SSHConfig.Timeout)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, server.SSHConfig)
 		if err != nil {
+			conn.Close()
 			log.Println(err)
+			//Retrying won't change the key the master presents
+			if strings.Contains(err.Error(), keys.ErrHostKeyMismatch.Error()) {
+				return backoff.Permanent(err)
+			}
 			return err
 		}
+		//Whatever ends this attempt, the next one starts on a fresh connection
+		defer sshConn.Close()
+		if next != nil {
+			finishRotation(next.used)
+		}
+		//The key is authorized now, reconnects shouldn't spend the token again
+		server.Token = ""
+		server.Conn = sshConn
+		go server.handleGlobalRequests(reqs)
+		client := ssh.NewClient(sshConn, chans, closedRequests())
+		//Jobs wait here until the hello is done
+		jobChans := client.HandleChannelOpen(jobChannelType)
 		channel, _, err := client.Conn.OpenChannel("session", make([]byte, 1024))
 		if err != nil {
 			return err
 		}
+		server.Lock()
 		server.Channel = channel
+		server.stream = newWireStream(channel)
 		server.Closed = false
-		err = server.ProcessReqs()
+		server.Unlock()
+		err = server.ProcessReqs(jobChans)
 		if err != nil {
 			return err
 		}
@@ -144,74 +251,235 @@ func (server *Server) Connect() {
 }
 
 //ProcessReqs TODO: Ensure this works like I think it does.  I believe this should just run forever and attempt reconnect on failures
-func (server *Server) ProcessReqs() error {
+func (server *Server) ProcessReqs(jobChans <-chan ssh.NewChannel) error {
+	err := server.hello()
+	if err != nil {
+		server.closeChannel()
+		return err
+	}
+	if server.Protocol.Version >= factsVersion {
+		err = server.sendFacts()
+		if err != nil {
+			server.closeChannel()
+			return err
+		}
+	}
+	go server.handleJobChannels(jobChans)
 	go server.sendStatus()
 	log.Println("Reading channel")
-	var message datums.ServerMessage
-	dec := gob.NewDecoder(server.Channel)
 	for {
-		err := dec.Decode(&message)
+		env, err := server.stream.read()
 		if err != nil {
-			server.Closed = true
-			server.Channel.Close()
+			server.closeChannel()
 			return err
 		}
-		log.Println(&message)
-		result, err := message.Execute()
+		payload, err := server.stream.open(env)
 		if err != nil {
-			server.Closed = true
-			server.Channel.Close()
-			return err
+			//Tell the master rather than dropping the connection, it may be newer than us
+			log.Println("Unable to handle message ", env.ID, err)
+			err = server.send(&datums.ErrorMessage{Message: err.Error()}, env.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		switch message := payload.(type) {
+		case datums.ServerMessage:
+			//Masters that predate job channels send jobs inline
+			err := runJob(context.Background(), server.stream, env, message)
+			if err != nil {
+				server.closeChannel()
+				return err
+			}
+		case *datums.ErrorMessage:
+			log.Printf("Master failed to handle %s: %s", env.CorrelationID, message.Message)
+		default:
+			log.Printf("Unexpected %s message from master", env.Kind)
 		}
-		server.sendReturn(result)
 	}
 }
 
-//Send a message back to the server
-func (server *Server) sendReturn(message []string) error {
+//Mark the session closed so the heartbeat stops, the lock keeps it in step with reconnects
+func (server *Server) closeChannel() {
 	server.Lock()
 	defer server.Unlock()
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	status := datums.ClientResult{Name: clientHost, Results: message}
-	err := enc.Encode(&status)
+	server.Closed = true
+	server.Channel.Close()
+}
+
+func (server *Server) isClosed() bool {
+	server.RLock()
+	defer server.RUnlock()
+	return server.Closed
+}
+
+//Announce what this build speaks and wait for the master to pick
+func (server *Server) hello() error {
+	codecs, err := wireCodecs()
+	if err != nil {
+		return err
+	}
+	compression, err := wireCompression()
+	if err != nil {
+		return err
+	}
+	hello := datums.NewHello(Version)
+	hello.Codecs = codecs
+	hello.Compression = compression
+	hello.HeartbeatInterval = heartbeatInterval
+	err = server.send(hello, "")
+	if err != nil {
+		return err
+	}
+	env, err := server.stream.read()
+	if err != nil {
+		return err
+	}
+	payload, err := server.stream.open(env)
 	if err != nil {
 		return err
 	}
-	_, err = server.Channel.Write(buf.Bytes())
+	switch message := payload.(type) {
+	case *datums.HelloAck:
+		log.Printf("Master build %q speaks protocol %d with %s/%s", message.BuildVersion, message.Version, message.Codec, message.Compression)
+		server.Lock()
+		defer server.Unlock()
+		server.Protocol = message
+		return server.stream.agree(message)
+	case *datums.ErrorMessage:
+		return fmt.Errorf("master refused hello: %s", message.Message)
+	default:
+		return fmt.Errorf("expected hello from master, got %s", env.Kind)
+	}
+}
+
+//Wrap a payload in an envelope and write it to the server
+func (server *Server) send(payload interface{}, correlationID string) error {
+	server.Lock()
+	defer server.Unlock()
+	return server.stream.write(payload, correlationID)
+}
+
+//Run each job the master opens a channel for
+func (server *Server) handleJobChannels(chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		go server.runJobChannel(newChannel)
+	}
+}
+
+//Run a job on the channel the master opened for it, the master closes the channel to cancel the job
+func (server *Server) runJobChannel(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+	server.RLock()
+	protocol := server.Protocol
+	server.RUnlock()
+	stream := newWireStream(channel)
+	err = stream.agree(protocol)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	env, err := stream.read()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	payload, err := stream.open(env)
+	if err != nil {
+		log.Println("Unable to handle job ", env.ID, err)
+		stream.write(&datums.ErrorMessage{Message: err.Error()}, env.ID)
+		return
+	}
+	message, ok := payload.(datums.ServerMessage)
+	if !ok {
+		stream.write(&datums.ErrorMessage{Message: "expected a job, got " + env.Kind}, env.ID)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		//Nothing else comes in on a job channel, reading only stops once the master closes it
+		for {
+			if _, err := stream.read(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+	err = runJob(ctx, stream, env, message)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//Run a job and answer on the stream it came in on
+func runJob(ctx context.Context, stream *wireStream, env *datums.Envelope, message datums.ServerMessage) error {
+	log.Println(message)
+	//Masters from before streaming drop output chunks, they get the output in the result instead
+	var output datums.OutputFunc
+	if stream.version >= streamingVersion {
+		output = streamOutput(stream, message.GetJID(), env.ID)
+	}
+	result, err := message.Execute(ctx, output)
 	if err != nil {
 		return err
 	}
-	return nil
+	return sendResult(stream, message.GetJID(), result, env.ID)
+}
+
+//Send output to the server as a job produces it, chunks are numbered in the order they are sent
+func streamOutput(stream *wireStream, jid, correlationID string) datums.OutputFunc {
+	var lock sync.Mutex
+	seq := 0
+	return func(index int, source string, data []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		seq++
+		chunk := datums.OutputChunk{
+			ID:     minionID,
+			Name:   minionName(),
+			JID:    jid,
+			Index:  index,
+			Stream: source,
+			Seq:    seq,
+			Data:   string(data),
+		}
+		if err := stream.write(&chunk, correlationID); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//Send the result of a job back to the server
+func sendResult(stream *wireStream, jid string, actions []datums.ActionResult, correlationID string) error {
+	result := datums.ClientResult{ID: minionID, Name: minionName(), JID: jid, Actions: actions}
+	return stream.write(&result, correlationID)
 }
 
 //TODO: Update the ClientStatus with a lot more system info
 func (server *Server) sendStatus() {
-	defer server.Unlock()
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
 	for t := range ticker.C {
 		log.Println(t)
+		if server.isClosed() {
+			return
+		}
 		status := datums.ClientStatus{
-			Name:    clientHost,
+			ID:      minionID,
+			Name:    minionName(),
 			Message: "keepalive",
 		}
-		err := enc.Encode(&status)
+		err := server.send(&status, "")
 		if err != nil {
 			log.Println(err)
-			continue
+			return
 		}
-		if !server.Closed {
-			server.Lock()
-			_, err = server.Channel.Write(buf.Bytes())
-			server.Unlock()
-			if err != nil {
-				return
-			}
-			buf.Reset()
-			continue
-		}
-		return
 	}
 }
@@ -15,30 +15,41 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/charles-d-burton/hansel/datums"
 	"github.com/spf13/cobra"
 )
 
 var (
-	hostPattern string
+	hostPattern    string
+	hostMatch      string
+	targetLabels   map[string]string
+	targetFacts    map[string]string
+	targetGroup    string
+	targetAll      bool
+	controlDryRun  bool
+	controlTimeout time.Duration
 )
 
 // controllerCmd represents the controller command
 var controlCmd = &cobra.Command{
-	Use:   "control",
+	Use:   "control [action]...",
 	Short: "Control machines or the runner",
 	Long:  `Used to issue commands against remotes or schedule commands`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("controller called")
-		err := doControl()
+		err := doControl(args)
 		if err != nil {
 			fmt.Println(err)
+			os.Exit(1)
 		}
 
 	},
@@ -54,27 +65,41 @@ func init() {
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
-	controlCmd.Flags().StringVarP(&hostPattern, "hosts", "h", ".*", "PCRE host lookup (required)")
-	controlCmd.MarkFlagRequired("hosts")
+	controlCmd.Flags().StringVarP(&hostPattern, "hosts", "h", "", "Minions to target, matched as --match says")
+	controlCmd.Flags().StringVar(&hostMatch, "match", datums.MatchRegex, "How --hosts is matched against minion IDs and hostnames: regex, glob, a comma separated list or a compound expression")
+	controlCmd.Flags().StringToStringVarP(&targetLabels, "labels", "L", nil, "Only target minions with these labels, e.g. role=db,region=us-east")
+	controlCmd.Flags().StringToStringVarP(&targetFacts, "facts", "F", nil, "Only target minions with these facts, e.g. host.platform=ubuntu, values can be globs")
+	controlCmd.Flags().StringVar(&targetGroup, "group", "", "Only target minions in this node group")
+	controlCmd.Flags().BoolVar(&targetAll, "all", false, "Target every minion, needed when no other target is given")
+	controlCmd.Flags().BoolVar(&controlDryRun, "dry-run", false, "Show the minions that would be targeted without running anything")
+	controlCmd.Flags().DurationVar(&controlTimeout, "timeout", defaultJobTimeout, "How long to wait for the targeted minions to answer")
 }
 
-func doControl() error {
+func doControl(actions []string) error {
 	var controller datums.ControllerReq
-	if hostPattern != "" {
-		controller.Pattern = hostPattern
-	}
+	controller.Pattern = hostPattern
+	controller.Match = hostMatch
+	controller.Labels = targetLabels
+	controller.Facts = targetFacts
+	controller.Group = targetGroup
+	controller.All = targetAll
+	controller.DryRun = controlDryRun
+	controller.Actions = actions
+	controller.Timeout = controlTimeout
 	c, err := net.Dial("unix", domainSocketAddr)
 	if err != nil {
 		return err
 	}
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err = enc.Encode(controller)
+	enc := controlCodec().NewEncoder(c)
+	err = enc.Encode(&datums.SocketReq{Control: &controller})
 	if err != nil {
 		log.Println(err)
 	}
-	_, err = c.Write(buf.Bytes())
-	err = listenForResult(c)
+	if controller.DryRun {
+		err = listTargets(c)
+	} else {
+		err = listenForResult(c)
+	}
 	c.Close()
 	if err != nil {
 		return err
@@ -82,19 +107,159 @@ func doControl() error {
 	return nil
 }
 
+//Print results as they come in until the server says the job is done
 func listenForResult(c net.Conn) error {
 	log.Println("Reading Control Stream")
-	var message datums.ClientResult
+	dec := controlCodec().NewDecoder(c)
+	streams := make(map[string]*outputStream)
+	var targets, answered int
 	for {
-		dec := gob.NewDecoder(c)
-		err := dec.Decode(&message)
+		var event datums.JobEvent
+		err := dec.Decode(&event)
 		if err != nil {
-			if err.Error() != "EOF" {
-				log.Println(err)
-				return err
+			return errors.New("no response from server: " + err.Error())
+		}
+		switch {
+		case event.Error != "":
+			return errors.New(event.Error)
+		case event.Output != nil:
+			stream, ok := streams[event.Output.ID]
+			if !ok {
+				stream = newOutputStream()
+				streams[event.Output.ID] = stream
+			}
+			for _, chunk := range stream.add(event.Output) {
+				printChunk(chunk)
+			}
+		case event.Result != nil:
+			//Whatever is still out of order won't be filled in now
+			if stream, ok := streams[event.Result.ID]; ok {
+				for _, chunk := range stream.flush() {
+					printChunk(chunk)
+				}
+			}
+			printResult(event.Result)
+			answered++
+		case event.Done:
+			fmt.Printf("Job %s: %d of %d targeted minions answered\n", event.JID, answered, targets)
+			var problems []string
+			if len(event.Missing) > 0 {
+				problems = append(problems, "no answer from: "+strings.Join(event.Missing, ", "))
+			}
+			if len(event.Offline) > 0 {
+				problems = append(problems, "not connected: "+strings.Join(event.Offline, ", "))
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("job %s: %s", event.JID, strings.Join(problems, "; "))
+			}
+			if targets == 0 {
+				return fmt.Errorf("job %s matched no minions", event.JID)
 			}
 			return nil
+		default:
+			targets = len(event.Targets)
+			fmt.Printf("Job %s sent to %d minions: %s\n", event.JID, targets, strings.Join(event.Targets, ", "))
+			if len(event.Offline) > 0 {
+				fmt.Printf("Not connected: %s\n", strings.Join(event.Offline, ", "))
+			}
+		}
+	}
+}
+
+//Print the minions a dry run would have targeted
+func listTargets(c net.Conn) error {
+	var event datums.JobEvent
+	err := controlCodec().NewDecoder(c).Decode(&event)
+	if err != nil {
+		return errors.New("no response from server: " + err.Error())
+	}
+	if event.Error != "" {
+		return errors.New(event.Error)
+	}
+	fmt.Printf("Would target %d minions:\n", len(event.Targets))
+	for _, id := range event.Targets {
+		fmt.Println("  " + id)
+	}
+	if len(event.Offline) > 0 {
+		return fmt.Errorf("not connected: %s", strings.Join(event.Offline, ", "))
+	}
+	return nil
+}
+
+//Output from one minion, chunks are held back until the ones before them have arrived
+type outputStream struct {
+	next    int
+	pending map[int]*datums.OutputChunk
+}
+
+func newOutputStream() *outputStream {
+	return &outputStream{next: 1, pending: make(map[int]*datums.OutputChunk)}
+}
+
+//Add a chunk and return the ones that are now in order
+func (stream *outputStream) add(chunk *datums.OutputChunk) []*datums.OutputChunk {
+	if chunk.Seq < stream.next {
+		return nil
+	}
+	stream.pending[chunk.Seq] = chunk
+	var ready []*datums.OutputChunk
+	for {
+		next, ok := stream.pending[stream.next]
+		if !ok {
+			return ready
+		}
+		delete(stream.pending, stream.next)
+		ready = append(ready, next)
+		stream.next++
+	}
+}
+
+//Return everything still held back in order, skipping the gaps
+func (stream *outputStream) flush() []*datums.OutputChunk {
+	seqs := make([]int, 0, len(stream.pending))
+	for seq := range stream.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	var ready []*datums.OutputChunk
+	for _, seq := range seqs {
+		ready = append(ready, stream.pending[seq])
+		delete(stream.pending, seq)
+		stream.next = seq + 1
+	}
+	return ready
+}
+
+func printChunk(chunk *datums.OutputChunk) {
+	prefix := fmt.Sprintf("%s [%d] ", chunk.ID, chunk.Index)
+	if chunk.Stream == datums.StreamStderr {
+		prefix += "stderr: "
+	}
+	fmt.Print(indent(chunk.Data, prefix))
+}
+
+func printResult(result *datums.ClientResult) {
+	fmt.Printf("%s (%s):\n", result.ID, result.Name)
+	for _, action := range result.Actions {
+		fmt.Printf("  [%d] %s\n", action.Index, action.Action)
+		//Minions that stream their output leave it out of the result
+		if action.Output != "" {
+			fmt.Print(indent(action.Output, "    "))
 		}
-		fmt.Printf("%+v\n", message)
+		if action.Error != "" {
+			fmt.Printf("    error: %s\n", action.Error)
+		}
+	}
+}
+
+func indent(text, prefix string) string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	out := prefix + strings.Join(lines, prefix)
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
 	}
+	return out
 }
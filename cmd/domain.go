@@ -0,0 +1,89 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"github.com/charles-d-burton/hansel/datums"
+)
+
+//Listen on the domain socket for requests from the local control commands
+func listenAndServeDomain() {
+	if err := os.Remove(domainSocketAddr); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	listener, err := net.Listen("unix", domainSocketAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chmod(domainSocketAddr, 0600); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Listening on ", domainSocketAddr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		go handleDomainConn(conn)
+	}
+}
+
+//Decode a single request from the socket and dispatch it
+func handleDomainConn(conn net.Conn) {
+	defer conn.Close()
+	var req datums.SocketReq
+	dec := controlCodec().NewDecoder(conn)
+	if err := dec.Decode(&req); err != nil {
+		log.Println("Failed reading from domain socket", err)
+		return
+	}
+	enc := controlCodec().NewEncoder(conn)
+	switch {
+	case req.Keys != nil:
+		result := handleKeyReq(req.Keys)
+		if err := enc.Encode(&result); err != nil {
+			log.Println(err)
+		}
+	case req.Tokens != nil:
+		result := handleTokenReq(req.Tokens)
+		if err := enc.Encode(&result); err != nil {
+			log.Println(err)
+		}
+	case req.Presence != nil:
+		result := handlePresenceReq(req.Presence)
+		if err := enc.Encode(&result); err != nil {
+			log.Println(err)
+		}
+	case req.Facts != nil:
+		result := handleFactsReq(req.Facts)
+		if err := enc.Encode(&result); err != nil {
+			log.Println(err)
+		}
+	case req.Groups != nil:
+		result := handleGroupsReq(req.Groups)
+		if err := enc.Encode(&result); err != nil {
+			log.Println(err)
+		}
+	case req.Control != nil:
+		handleControlReq(req.Control, enc, dec)
+	default:
+		log.Println("Received empty request on domain socket")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+//First protocol version where minions report their facts
+const factsVersion = 4
+
+var minionLabels map[string]string
+
+var factsCmd = &cobra.Command{
+	Use:   "facts [pattern]",
+	Short: "Show the labels and facts of connected minions",
+	Long: `Show the labels and facts each connected minion reported when it connected, these are what
+hansel control --labels and --facts target.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var req datums.FactsReq
+		if len(args) > 0 {
+			req.Pattern = args[0]
+		}
+		result, err := sendFactsReq(&req)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if result.Error != "" {
+			fmt.Println(result.Error)
+			os.Exit(1)
+		}
+		printFacts(result.Minions)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(factsCmd)
+	clientCmd.Flags().StringToStringVar(&minionLabels, "labels", nil, "Labels to report to the master, e.g. role=db,region=us-east, added to the labels in the config file")
+}
+
+//Labels from the config file with any given on the command line on top
+func configuredLabels() map[string]string {
+	labels := make(map[string]string)
+	for key, value := range viper.GetStringMapString("labels") {
+		labels[key] = value
+	}
+	for key, value := range minionLabels {
+		labels[key] = value
+	}
+	return labels
+}
+
+//Tell the master about this minion so it can be targeted by labels and facts
+func (server *Server) sendFacts() error {
+	facts, err := datums.GatherFacts()
+	if err != nil {
+		log.Println("Unable to gather every fact ", err)
+	}
+	return server.send(&datums.Facts{
+		ID:     minionID,
+		Name:   minionName(),
+		Labels: configuredLabels(),
+		Facts:  facts,
+	}, "")
+}
+
+//Store the facts a minion reported, labels the master assigned win over the ones the minion reports
+func (client *Client) setFacts(facts *datums.Facts) {
+	labels := make(map[string]string)
+	for key, value := range facts.Labels {
+		labels[key] = value
+	}
+	if record, ok := keyStore.Get(client.ID); ok {
+		for key, value := range record.Labels {
+			labels[key] = value
+		}
+	}
+	client.Lock()
+	defer client.Unlock()
+	client.Labels = labels
+	client.Facts = facts.Facts
+}
+
+//Labels and facts of every connected minion matching the pattern
+func handleFactsReq(req *datums.FactsReq) datums.FactsResult {
+	var result datums.FactsResult
+	for _, client := range registry.List() {
+		if req.Pattern != "" {
+			matched, err := matchPresence(req.Pattern, datums.PresenceEntry{ID: client.ID, Hostname: client.Name})
+			if err != nil {
+				return datums.FactsResult{Error: err.Error()}
+			}
+			if !matched {
+				continue
+			}
+		}
+		client.RLock()
+		result.Minions = append(result.Minions, datums.Facts{
+			ID:     client.ID,
+			Name:   client.Name,
+			Labels: client.Labels,
+			Facts:  client.Facts,
+		})
+		client.RUnlock()
+	}
+	return result
+}
+
+func sendFactsReq(req *datums.FactsReq) (*datums.FactsResult, error) {
+	c, err := net.Dial("unix", domainSocketAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	err = controlCodec().NewEncoder(c).Encode(&datums.SocketReq{Facts: req})
+	if err != nil {
+		return nil, err
+	}
+	var result datums.FactsResult
+	err = controlCodec().NewDecoder(c).Decode(&result)
+	if err != nil {
+		return nil, errors.New("no response from server: " + err.Error())
+	}
+	return &result, nil
+}
+
+func printFacts(minions []datums.Facts) {
+	for _, minion := range minions {
+		fmt.Printf("%s (%s):\n", minion.ID, minion.Name)
+		for _, key := range datums.SortedKeys(minion.Labels) {
+			fmt.Printf("  label %s=%s\n", key, minion.Labels[key])
+		}
+		for _, key := range datums.SortedKeys(minion.Facts) {
+			fmt.Printf("  %s=%s\n", key, minion.Facts[key])
+		}
+	}
+}
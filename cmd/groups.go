@@ -0,0 +1,188 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/charles-d-burton/hansel/target"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const groupsFile = "/etc/hansel/groups.yml"
+
+var (
+	groupsPath string
+	//The parsed groups, reloaded when the file changes
+	groupsCache = struct {
+		sync.Mutex
+		modTime time.Time
+		groups  map[string]string
+	}{}
+)
+
+//NodeGroups names target expressions so they can be reused, groups can include each other with N@
+type NodeGroups struct {
+	Groups map[string]string `yaml:"groups"`
+}
+
+var groupsCmd = &cobra.Command{
+	Use:   "groups",
+	Short: "Manage node groups",
+	Long: `Node groups are named target expressions defined in the master's groups file, target them with
+hansel control --group or N@name in a compound expression.  The file is reloaded when it changes.`,
+}
+
+var groupsListCmd = &cobra.Command{
+	Use:   "list [pattern]",
+	Short: "List node groups and the connected minions in them",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var req datums.GroupsReq
+		if len(args) > 0 {
+			req.Pattern = args[0]
+		}
+		result, err := sendGroupsReq(&req)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if result.Error != "" {
+			fmt.Println(result.Error)
+			os.Exit(1)
+		}
+		printGroups(result.Groups)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(groupsCmd)
+	groupsCmd.AddCommand(groupsListCmd)
+	serveCmd.Flags().StringVar(&groupsPath, "groups-file", groupsFile, "Node groups minions can be targeted by")
+}
+
+//Load the groups file if it changed, a missing file means there are no groups.  Every group is parsed
+//so a bad one is reported as soon as the file is loaded.
+func loadGroups(file string) (map[string]string, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	groupsCache.Lock()
+	defer groupsCache.Unlock()
+	if groupsCache.groups != nil && info.ModTime().Equal(groupsCache.modTime) {
+		return groupsCache.groups, nil
+	}
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var nodeGroups NodeGroups
+	if err := yaml.Unmarshal(buffer, &nodeGroups); err != nil {
+		return nil, err
+	}
+	groups := nodeGroups.Groups
+	if groups == nil {
+		groups = make(map[string]string)
+	}
+	for name, expr := range groups {
+		if _, err := target.Parse(expr, groupLookup(groups)); err != nil {
+			return nil, fmt.Errorf("node group %s: %v", name, err)
+		}
+	}
+	log.Printf("Loaded %d node groups from %s", len(groups), file)
+	groupsCache.groups = groups
+	groupsCache.modTime = info.ModTime()
+	return groups, nil
+}
+
+func groupLookup(groups map[string]string) target.GroupFunc {
+	return func(name string) (string, bool) {
+		expr, ok := groups[name]
+		return expr, ok
+	}
+}
+
+//Every node group matching the pattern and the connected minions in it
+func handleGroupsReq(req *datums.GroupsReq) datums.GroupsResult {
+	groups, err := loadGroups(groupsPath)
+	if err != nil {
+		return datums.GroupsResult{Error: err.Error()}
+	}
+	ready := registry.Ready()
+	var result datums.GroupsResult
+	for _, name := range datums.SortedKeys(groups) {
+		if req.Pattern != "" {
+			matched, err := filepath.Match(req.Pattern, name)
+			if err != nil {
+				return datums.GroupsResult{Error: err.Error()}
+			}
+			if !matched {
+				continue
+			}
+		}
+		group := datums.NodeGroup{Name: name, Expr: groups[name]}
+		//Every group parsed when the file was loaded
+		expr, _ := target.Parse(groups[name], groupLookup(groups))
+		for _, client := range ready {
+			if expr.Match(client.targetMinion()) {
+				group.Minions = append(group.Minions, client.ID)
+			}
+		}
+		result.Groups = append(result.Groups, group)
+	}
+	return result
+}
+
+func sendGroupsReq(req *datums.GroupsReq) (*datums.GroupsResult, error) {
+	c, err := net.Dial("unix", domainSocketAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	err = controlCodec().NewEncoder(c).Encode(&datums.SocketReq{Groups: req})
+	if err != nil {
+		return nil, err
+	}
+	var result datums.GroupsResult
+	err = controlCodec().NewDecoder(c).Decode(&result)
+	if err != nil {
+		return nil, errors.New("no response from server: " + err.Error())
+	}
+	return &result, nil
+}
+
+func printGroups(groups []datums.NodeGroup) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMINIONS\tEXPRESSION")
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", group.Name, len(group.Minions), group.Expr)
+	}
+	w.Flush()
+}
@@ -0,0 +1,300 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+const (
+	//Jobs nobody answers are forgotten after this long
+	jobExpiry = 5 * time.Minute
+	//How long the control command waits for minions by default
+	defaultJobTimeout = 30 * time.Second
+	//JIDs are the dispatch time down to the microsecond
+	jidFormat = "20060102150405.000000"
+	//Channel the master opens on a minion for each job, the extra data is the JID
+	jobChannelType = "job@hansel"
+	//First protocol version where minions stream output as jobs run
+	streamingVersion = 2
+	//First protocol version with job channels
+	jobChannelVersion = 3
+)
+
+//A dispatched job and the results that have come back for it
+type job struct {
+	sync.Mutex
+	JID      string
+	targets  []string
+	reported map[string]bool
+	//Output and results in the order they came in, nil when nobody is waiting on the job
+	events chan *datums.JobEvent
+	done   chan struct{}
+	once   sync.Once
+	//Closing it closes every channel the job runs on
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+}
+
+//Jobs waiting on results indexed by JID
+var jobs = struct {
+	sync.Mutex
+	byJID map[string]*job
+	last  time.Time
+}{byJID: make(map[string]*job)}
+
+//Start tracking a job sent to the targeted minion IDs, watched jobs pass their output and results on
+//to whoever waits on them
+func startJob(targets []string, watched bool) *job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	var jid string
+	jid, jobs.last = newJID(jobs.last)
+	job := &job{
+		JID:       jid,
+		targets:   targets,
+		reported:  make(map[string]bool, len(targets)),
+		done:      make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	if watched {
+		job.events = make(chan *datums.JobEvent, 64)
+	}
+	jobs.byJID[jid] = job
+	time.AfterFunc(jobExpiry, func() {
+		finishJob(jid)
+	})
+	return job
+}
+
+//A JID is the dispatch time, two jobs in the same microsecond are pushed apart so JIDs stay unique
+//and sorted
+func newJID(last time.Time) (string, time.Time) {
+	now := time.Now().Truncate(time.Microsecond)
+	if !now.After(last) {
+		now = last.Add(time.Microsecond)
+	}
+	return strings.Replace(now.Format(jidFormat), ".", "", 1), now
+}
+
+//Stop tracking a job, results that come in later are dropped
+func finishJob(jid string) {
+	jobs.Lock()
+	job, ok := jobs.byJID[jid]
+	delete(jobs.byJID, jid)
+	jobs.Unlock()
+	if ok {
+		job.once.Do(func() { close(job.done) })
+	}
+}
+
+//Cancel a job on every minion still running it
+func (job *job) cancel() {
+	job.cancelOnce.Do(func() { close(job.cancelled) })
+	finishJob(job.JID)
+}
+
+func lookupJob(jid string) (*job, bool) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	job, ok := jobs.byJID[jid]
+	return job, ok
+}
+
+//Hand a result to the job it answers, only the first result from each targeted minion counts
+func recordJobResult(minionID string, result *datums.ClientResult) {
+	job, ok := lookupJob(result.JID)
+	if !ok {
+		log.Printf("Dropping result for unknown job %q from %s", result.JID, minionID)
+		return
+	}
+	job.Lock()
+	if !job.isTarget(minionID) || job.reported[minionID] {
+		job.Unlock()
+		log.Printf("Dropping unexpected result for job %s from %s", job.JID, minionID)
+		return
+	}
+	job.reported[minionID] = true
+	complete := len(job.reported) == len(job.targets)
+	job.Unlock()
+	job.send(&datums.JobEvent{JID: job.JID, Result: result})
+	if complete {
+		finishJob(job.JID)
+	}
+}
+
+//Pass output on to whoever is waiting on the job
+func recordJobOutput(minionID string, chunk *datums.OutputChunk) {
+	job, ok := lookupJob(chunk.JID)
+	if !ok || !job.isTarget(minionID) {
+		return
+	}
+	job.send(&datums.JobEvent{JID: job.JID, Output: chunk})
+}
+
+//A slow control command holds up the minions it is watching, a finished job drops the event
+func (job *job) send(event *datums.JobEvent) {
+	if job.events == nil {
+		return
+	}
+	select {
+	case job.events <- event:
+	case <-job.done:
+	}
+}
+
+func (job *job) isTarget(minionID string) bool {
+	for _, target := range job.targets {
+		if target == minionID {
+			return true
+		}
+	}
+	return false
+}
+
+//Hand each event to fn until every target has answered, the timeout passes or whoever is waiting goes
+//away, returns the targets that never answered.  Going away cancels the job.
+func (job *job) wait(timeout time.Duration, gone <-chan struct{}, fn func(*datums.JobEvent)) []string {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for received := 0; received < len(job.targets); {
+		select {
+		case event := <-job.events:
+			if event.Result != nil {
+				received++
+			}
+			fn(event)
+		case <-timer.C:
+			finishJob(job.JID)
+			return job.missing()
+		case <-gone:
+			log.Println("Cancelling job ", job.JID)
+			job.cancel()
+			return job.missing()
+		}
+	}
+	return nil
+}
+
+func (job *job) missing() []string {
+	job.Lock()
+	defer job.Unlock()
+	var missing []string
+	for _, target := range job.targets {
+		if !job.reported[target] {
+			missing = append(missing, target)
+		}
+	}
+	return missing
+}
+
+//Dispatch a job to every connected minion the request targets and stream the results back to the
+//control command, the job is cancelled if the control command goes away
+func handleControlReq(req *datums.ControllerReq, enc datums.Encoder, dec datums.Decoder) {
+	targets, offline, err := matchTargets(req)
+	if err != nil {
+		enc.Encode(&datums.JobEvent{Done: true, Error: err.Error()})
+		return
+	}
+	ids := make([]string, 0, len(targets))
+	for _, client := range targets {
+		ids = append(ids, client.ID)
+	}
+	if req.DryRun {
+		enc.Encode(&datums.JobEvent{Targets: ids, Offline: offline, Done: true})
+		return
+	}
+	job := startJob(ids, true)
+	log.Printf("Dispatching job %s to %d minions matching %q", job.JID, len(ids), req.Pattern)
+	if err := enc.Encode(&datums.JobEvent{JID: job.JID, Targets: ids, Offline: offline}); err != nil {
+		log.Println(err)
+	}
+	for _, client := range targets {
+		client.RLock()
+		send := client.Send
+		client.RUnlock()
+		//A client that can't keep up shows up as missing rather than holding up the rest
+		select {
+		case send <- &datums.CommandRunner{JID: job.JID, Actions: req.Actions}:
+		default:
+			log.Printf("Unable to send job %s to %s", job.JID, client.ID)
+		}
+	}
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+	gone := make(chan struct{})
+	go func() {
+		//Nothing more is sent, this only returns once the connection closes
+		var ignored datums.SocketReq
+		dec.Decode(&ignored)
+		close(gone)
+	}()
+	missing := job.wait(timeout, gone, func(event *datums.JobEvent) {
+		if err := enc.Encode(event); err != nil {
+			log.Println(err)
+		}
+	})
+	if err := enc.Encode(&datums.JobEvent{JID: job.JID, Done: true, Offline: offline, Missing: missing}); err != nil {
+		log.Println(err)
+	}
+}
+
+//Run a job on its own channel so its output can't hold up the control channel, closing the channel
+//cancels the job on the minion
+func runJobChannel(conn *ssh.ServerConn, client *Client, message datums.ServerMessage) {
+	jid := message.GetJID()
+	channel, reqs, err := conn.OpenChannel(jobChannelType, []byte(jid))
+	if err != nil {
+		log.Printf("Unable to open a channel for job %s on %s: %v", jid, client.ID, err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+	if job, ok := lookupJob(jid); ok {
+		go func() {
+			select {
+			case <-job.cancelled:
+				channel.Close()
+			case <-job.done:
+			}
+		}()
+	}
+	stream := newWireStream(channel)
+	err = stream.agree(client.Protocol)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = stream.write(message, "")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for {
+		env, err := stream.read()
+		if err != nil {
+			return
+		}
+		handleClientEnvelope(client, stream, env)
+	}
+}
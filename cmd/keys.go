@@ -0,0 +1,214 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/spf13/cobra"
+)
+
+var (
+	allKeys      bool
+	rotateMaster bool
+	rotateGrace  time.Duration
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage minion keys",
+	Long: `List, accept, reject and delete the keys of minions that have
+connected to the running server.  Changes take effect immediately.`,
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list [pattern]",
+	Short: "List minion keys",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeyAction(datums.KeyActionList, args)
+	},
+}
+
+var keysAcceptCmd = &cobra.Command{
+	Use:   "accept [--all|pattern]",
+	Short: "Move pending or rejected keys to authorized",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeyAction(datums.KeyActionAccept, args)
+	},
+}
+
+var keysRejectCmd = &cobra.Command{
+	Use:   "reject [--all|pattern]",
+	Short: "Move pending keys to rejected",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeyAction(datums.KeyActionReject, args)
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:   "revoke [--all|pattern]",
+	Short: "Revoke keys and disconnect their live sessions",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeyAction(datums.KeyActionRevoke, args)
+	},
+}
+
+var keysDeleteCmd = &cobra.Command{
+	Use:   "delete [--all|pattern]",
+	Short: "Delete keys from every store",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeyAction(datums.KeyActionDelete, args)
+	},
+}
+
+var keysShowCmd = &cobra.Command{
+	Use:   "show [pattern]",
+	Short: "Show everything known about minion keys, including their history",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := datums.KeyReq{Action: datums.KeyActionList}
+		if len(args) > 0 {
+			req.Pattern = args[0]
+		}
+		result, err := sendKeyReq(&req)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, key := range result.Keys {
+			printKey(key)
+		}
+		if result.Error != "" {
+			fmt.Println(result.Error)
+			os.Exit(1)
+		}
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate [--master|--all|pattern]",
+	Short: "Replace the master's host key or the keys of connected minions",
+	Long: `Rotate the keys of connected minions matching the pattern.  Each minion
+generates a new key, proves it holds it and the authorized store is updated
+in place.
+
+With --master the server generates a new host key and announces it to every
+minion, the old key is served until the grace period is over.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeyAction(datums.KeyActionRotate, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysListCmd, keysAcceptCmd, keysRejectCmd, keysRevokeCmd, keysDeleteCmd, keysShowCmd, keysRotateCmd)
+	keysCmd.PersistentFlags().BoolVarP(&allKeys, "all", "a", false, "Apply to every key")
+	keysRotateCmd.Flags().BoolVar(&rotateMaster, "master", false, "Rotate the master's host key")
+	keysRotateCmd.Flags().DurationVar(&rotateGrace, "grace", defaultRotationGrace, "How long the old host key is still served")
+}
+
+func runKeyAction(action string, args []string) {
+	req := datums.KeyReq{Action: action, All: allKeys, Master: rotateMaster, Grace: rotateGrace}
+	if current, err := user.Current(); err == nil {
+		req.By = current.Username
+	}
+	if len(args) > 0 {
+		req.Pattern = args[0]
+	}
+	result, err := sendKeyReq(&req)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	printKeys(result.Keys)
+	if result.Error != "" {
+		fmt.Println(result.Error)
+		os.Exit(1)
+	}
+}
+
+// Send a key request over the domain socket and wait for the result
+func sendKeyReq(req *datums.KeyReq) (*datums.KeyResult, error) {
+	c, err := net.Dial("unix", domainSocketAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	enc := controlCodec().NewEncoder(c)
+	err = enc.Encode(&datums.SocketReq{Keys: req})
+	if err != nil {
+		return nil, err
+	}
+	var result datums.KeyResult
+	dec := controlCodec().NewDecoder(c)
+	err = dec.Decode(&result)
+	if err != nil {
+		return nil, errors.New("no response from server: " + err.Error())
+	}
+	return &result, nil
+}
+
+func printKeys(keys []datums.KeyEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tID\tHOSTNAME\tVERSION\tFINGERPRINT\tLABELS")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", key.State, key.ID, key.Hostname, key.BuildVersion, key.Fingerprint, datums.FormatLabels(key.Labels))
+	}
+	w.Flush()
+}
+
+func printKey(key datums.KeyEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", key.ID)
+	fmt.Fprintf(w, "Fingerprint:\t%s\n", key.Fingerprint)
+	fmt.Fprintf(w, "State:\t%s\n", key.State)
+	fmt.Fprintf(w, "Public key:\t%s\n", key.PublicKey)
+	fmt.Fprintf(w, "Hostname:\t%s\n", key.Hostname)
+	fmt.Fprintf(w, "Source IP:\t%s\n", key.SourceIP)
+	fmt.Fprintf(w, "Labels:\t%s\n", datums.FormatLabels(key.Labels))
+	fmt.Fprintf(w, "First seen:\t%s\n", formatTime(key.FirstSeen))
+	fmt.Fprintf(w, "Last seen:\t%s\n", formatTime(key.LastSeen))
+	fmt.Fprintf(w, "Accepted by:\t%s\n", key.AcceptedBy)
+	fmt.Fprintf(w, "Accepted at:\t%s\n", formatTime(key.AcceptedAt))
+	fmt.Fprintf(w, "Build version:\t%s\n", key.BuildVersion)
+	fmt.Fprintf(w, "Protocol:\t%d\n", key.Protocol)
+	fmt.Fprintln(w, "History:")
+	for _, event := range key.History {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", formatTime(event.Time), event.State, event.By, event.Note)
+	}
+	fmt.Fprintln(w)
+	w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
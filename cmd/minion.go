@@ -0,0 +1,119 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+const (
+	minionIDFile = "/etc/hansel/minion_id"
+	//The minion's hostname is sent as a comment after the version so it is known during auth
+	clientVersionPrefix = "SSH-2.0-hansel "
+)
+
+var (
+	minionID string
+	//IDs are used as the SSH user so they are kept to characters that are safe everywhere
+	minionIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	machineIDFiles  = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+)
+
+//Work out the minion's ID.  An ID set in the config wins, then the one saved on first run, otherwise
+//a new random ID is saved.  The machine-id is only used if the new ID can't be saved.
+func loadMinionID() (string, error) {
+	if id := viper.GetString("id"); id != "" {
+		return id, validateMinionID(id)
+	}
+	buffer, err := ioutil.ReadFile(minionIDFile)
+	if err == nil {
+		id := strings.TrimSpace(string(buffer))
+		return id, validateMinionID(id)
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	id, err := newMinionID()
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(minionIDFile, []byte(id+"\n"), 0644); err != nil {
+		log.Println("Unable to save minion ID, using the machine-id instead: ", err)
+		return machineID()
+	}
+	log.Println("Generated minion ID ", id)
+	return id, nil
+}
+
+//A random UUID, hostnames get cloned and renamed but this doesn't
+func newMinionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func machineID() (string, error) {
+	for _, file := range machineIDFiles {
+		buffer, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(buffer)); id != "" {
+			return id, validateMinionID(id)
+		}
+	}
+	return "", fmt.Errorf("unable to save %s and no machine-id was found", minionIDFile)
+}
+
+func validateMinionID(id string) error {
+	if !minionIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid minion ID %q", id)
+	}
+	return nil
+}
+
+//The hostname a minion reported, minions that don't send one are known by their ID
+func minionHostname(connMeta ssh.ConnMetadata) string {
+	version := string(connMeta.ClientVersion())
+	if strings.HasPrefix(version, clientVersionPrefix) {
+		if hostname := strings.TrimSpace(strings.TrimPrefix(version, clientVersionPrefix)); hostname != "" {
+			return hostname
+		}
+	}
+	return connMeta.User()
+}
+
+//The hostname reported alongside the minion ID
+func minionName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return minionID
+	}
+	return name
+}
@@ -0,0 +1,235 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	ssh "golang.org/x/crypto/ssh"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	policyFile = "/etc/hansel/policy.yml"
+
+	PolicyAccept  = "accept"
+	PolicyReject  = "reject"
+	PolicyPending = "pending"
+)
+
+var (
+	policyPath string
+	//The parsed policy, reloaded when the file changes
+	policyCache = struct {
+		sync.Mutex
+		modTime time.Time
+		policy  *Policy
+	}{}
+)
+
+//Policy decides what happens to keys that aren't authorized yet, the first matching rule wins
+type Policy struct {
+	Default string       `yaml:"default"`
+	Rules   []PolicyRule `yaml:"rules"`
+}
+
+//PolicyRule matches when every condition that is set matches
+type PolicyRule struct {
+	Name     string   `yaml:"name"`
+	Action   string   `yaml:"action"`
+	Hostname string   `yaml:"hostname"`
+	CIDRs    []string `yaml:"cidrs"`
+	Version  string   `yaml:"version"`
+	Hours    string   `yaml:"hours"`
+
+	hostname *regexp.Regexp
+	networks []*net.IPNet
+	version  *regexp.Regexp
+	start    time.Duration
+	end      time.Duration
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&policyPath, "policy-file", policyFile, "Policy for accepting or rejecting new keys")
+}
+
+//Decide what to do with a key that isn't authorized and which rule decided it, without a policy
+//file everything is pending
+func evaluatePolicy(connMeta ssh.ConnMetadata, sha string) (string, string) {
+	policy, err := loadPolicy(policyPath)
+	if err != nil {
+		log.Println("Policy not loaded, leaving key pending: ", err)
+		return PolicyPending, "default"
+	}
+	action, rule := PolicyPending, "default"
+	if policy != nil {
+		action = policy.Default
+		for _, r := range policy.Rules {
+			if r.matches(connMeta, time.Now()) {
+				action, rule = r.Action, r.Name
+				break
+			}
+		}
+	}
+	log.Printf("Policy %s for %s (%s) from %s [%s] by rule %s",
+		action, connMeta.User(), sha, connMeta.RemoteAddr(), connMeta.ClientVersion(), rule)
+	return action, rule
+}
+
+func (rule *PolicyRule) matches(connMeta ssh.ConnMetadata, now time.Time) bool {
+	if rule.hostname != nil && !rule.hostname.MatchString(minionHostname(connMeta)) {
+		return false
+	}
+	if rule.version != nil && !rule.version.Match(connMeta.ClientVersion()) {
+		return false
+	}
+	if len(rule.networks) > 0 {
+		host, _, err := net.SplitHostPort(connMeta.RemoteAddr().String())
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		found := false
+		for _, network := range rule.networks {
+			if ip != nil && network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.Hours != "" {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		offset := now.Sub(midnight)
+		//A window like 22:00-06:00 wraps past midnight
+		if rule.start <= rule.end && (offset < rule.start || offset >= rule.end) {
+			return false
+		}
+		if rule.start > rule.end && offset < rule.start && offset >= rule.end {
+			return false
+		}
+	}
+	return true
+}
+
+//Load the policy file if it changed, a missing file means there is no policy
+func loadPolicy(file string) (*Policy, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	policyCache.Lock()
+	defer policyCache.Unlock()
+	if policyCache.policy != nil && info.ModTime().Equal(policyCache.modTime) {
+		return policyCache.policy, nil
+	}
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parsePolicy(buffer)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Loaded policy ", file)
+	policyCache.policy = policy
+	policyCache.modTime = info.ModTime()
+	return policy, nil
+}
+
+func parsePolicy(buffer []byte) (*Policy, error) {
+	var policy Policy
+	if err := yaml.Unmarshal(buffer, &policy); err != nil {
+		return nil, err
+	}
+	if policy.Default == "" {
+		policy.Default = PolicyPending
+	}
+	if err := validAction(policy.Default); err != nil {
+		return nil, err
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := validAction(rule.Action); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		var err error
+		if rule.Hostname != "" {
+			if rule.hostname, err = regexp.Compile(rule.Hostname); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+		if rule.Version != "" {
+			if rule.version, err = regexp.Compile(rule.Version); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+		for _, cidr := range rule.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+			rule.networks = append(rule.networks, network)
+		}
+		if rule.Hours != "" {
+			if rule.start, rule.end, err = parseHours(rule.Hours); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+func validAction(action string) error {
+	switch action {
+	case PolicyAccept, PolicyReject, PolicyPending:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy action %q", action)
+	}
+}
+
+//Parse a window of the day like 08:00-18:00 into offsets from midnight
+func parseHours(hours string) (time.Duration, time.Duration, error) {
+	startAndEnd := strings.SplitN(hours, "-", 2)
+	if len(startAndEnd) != 2 {
+		return 0, 0, fmt.Errorf("hours must look like 08:00-18:00, got %q", hours)
+	}
+	var offsets [2]time.Duration
+	for i, clock := range startAndEnd {
+		t, err := time.Parse("15:04", strings.TrimSpace(clock))
+		if err != nil {
+			return 0, 0, err
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return offsets[0], offsets[1], nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ssh "golang.org/x/crypto/ssh"
+)
+
+//Just enough of a connection for policy rules to look at
+type fakeConnMeta struct {
+	user    string
+	version string
+	addr    string
+	session string
+}
+
+func (meta fakeConnMeta) User() string          { return meta.user }
+func (meta fakeConnMeta) SessionID() []byte     { return []byte(meta.session) }
+func (meta fakeConnMeta) ClientVersion() []byte { return []byte(meta.version) }
+func (meta fakeConnMeta) ServerVersion() []byte { return nil }
+func (meta fakeConnMeta) LocalAddr() net.Addr   { return nil }
+func (meta fakeConnMeta) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", meta.addr)
+	return addr
+}
+
+var _ ssh.ConnMetadata = fakeConnMeta{}
+
+//A connection that has finished its handshake, for the code that runs after it
+type fakeConn struct {
+	fakeConnMeta
+}
+
+func (fakeConn) SendRequest(string, bool, []byte) (bool, []byte, error) { return false, nil, nil }
+func (fakeConn) OpenChannel(string, []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, errors.New("no channels")
+}
+func (fakeConn) Close() error { return nil }
+func (fakeConn) Wait() error  { return nil }
+
+func serverConn(meta fakeConnMeta, perms *ssh.Permissions) *ssh.ServerConn {
+	return &ssh.ServerConn{Conn: fakeConn{meta}, Permissions: perms}
+}
+
+const testPolicy = `
+default: reject
+rules:
+  - name: lab
+    action: accept
+    cidrs: ["10.0.0.0/8", "192.168.1.0/24"]
+    hostname: ^web-
+  - name: night
+    action: pending
+    hours: 22:00-06:00
+  - action: accept
+    version: ^SSH-2.0-hansel
+    hours: 08:00-18:00
+`
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Default != PolicyReject || len(policy.Rules) != 3 {
+		t.Fatalf("got %+v", policy)
+	}
+	if name := policy.Rules[2].Name; name != "#3" {
+		t.Errorf("unnamed rule is called %q", name)
+	}
+	lab := policy.Rules[0]
+	if len(lab.networks) != 2 || lab.hostname == nil {
+		t.Errorf("lab rule conditions weren't compiled: %+v", lab)
+	}
+	night := policy.Rules[1]
+	if night.start != 22*time.Hour || night.end != 6*time.Hour {
+		t.Errorf("night rule runs %s-%s", night.start, night.end)
+	}
+	empty, err := parsePolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Default != PolicyPending {
+		t.Errorf("empty policy defaults to %q", empty.Default)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	policies := map[string]string{
+		"default: maybe":                                     "unknown policy action",
+		"rules:\n  - action: allow":                          "unknown policy action",
+		"rules:\n  - action: accept\n    hostname: (":        "rule #1",
+		"rules:\n  - action: accept\n    version: (":         "rule #1",
+		"rules:\n  - action: accept\n    cidrs: [10/8]":      "invalid CIDR",
+		"rules:\n  - action: accept\n    hours: 9-5":         "parsing time",
+		"rules:\n  - action: accept\n    hours: 09:00":       "hours must look like",
+		"rules:\n  - action: accept\n    hours: 25:00-26:00": "rule #1",
+	}
+	for policy, want := range policies {
+		_, err := parsePolicy([]byte(policy))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gave %v, want an error containing %q", policy, err, want)
+		}
+	}
+}
+
+func TestParseHours(t *testing.T) {
+	start, end, err := parseHours(" 08:30 - 17:45 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 8*time.Hour+30*time.Minute || end != 17*time.Hour+45*time.Minute {
+		t.Errorf("got %s-%s", start, end)
+	}
+}
+
+func TestPolicyRuleMatches(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lab, night, office := policy.Rules[0], policy.Rules[1], policy.Rules[2]
+	day := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local)
+	}
+	hansel := clientVersionPrefix + "web-1"
+	tests := []struct {
+		name string
+		rule PolicyRule
+		meta fakeConnMeta
+		now  time.Time
+		want bool
+	}{
+		{"lab by cidr and hostname", lab, fakeConnMeta{"id", hansel, "10.1.2.3:1234", ""}, day(12, 0), true},
+		{"lab wrong network", lab, fakeConnMeta{"id", hansel, "172.16.0.1:1234", ""}, day(12, 0), false},
+		{"lab wrong hostname", lab, fakeConnMeta{"id", clientVersionPrefix + "db-1", "10.1.2.3:1234", ""}, day(12, 0), false},
+		{"lab hostname falls back to user", lab, fakeConnMeta{"web-9", "SSH-2.0-OpenSSH_9.0", "192.168.1.9:1234", ""}, day(12, 0), true},
+		{"night before midnight", night, fakeConnMeta{"id", hansel, "10.0.0.1:1", ""}, day(23, 0), true},
+		{"night after midnight", night, fakeConnMeta{"id", hansel, "10.0.0.1:1", ""}, day(5, 59), true},
+		{"night ends at 06:00", night, fakeConnMeta{"id", hansel, "10.0.0.1:1", ""}, day(6, 0), false},
+		{"night not at noon", night, fakeConnMeta{"id", hansel, "10.0.0.1:1", ""}, day(12, 0), false},
+		{"office starts at 08:00", office, fakeConnMeta{"id", hansel, "10.0.0.1:1", ""}, day(8, 0), true},
+		{"office ends at 18:00", office, fakeConnMeta{"id", hansel, "10.0.0.1:1", ""}, day(18, 0), false},
+		{"office needs the version", office, fakeConnMeta{"id", "SSH-2.0-OpenSSH_9.0", "10.0.0.1:1", ""}, day(9, 0), false},
+	}
+	for _, test := range tests {
+		if got := test.rule.matches(test.meta, test.now); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/spf13/cobra"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultHeartbeatInterval = 2 * time.Second
+	defaultHeartbeatMisses   = 3
+)
+
+var (
+	heartbeatInterval = defaultHeartbeatInterval
+	heartbeatMisses   int
+)
+
+//intervalValue is a duration flag that only takes heartbeat intervals the master accepts, tickers
+//panic on intervals that aren't positive
+type intervalValue time.Duration
+
+func (value *intervalValue) Set(s string) error {
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 || interval > datums.MaxHeartbeatInterval {
+		return fmt.Errorf("heartbeat interval must be more than 0 and at most %s", datums.MaxHeartbeatInterval)
+	}
+	*value = intervalValue(interval)
+	return nil
+}
+
+func (value *intervalValue) String() string {
+	return time.Duration(*value).String()
+}
+
+func (value *intervalValue) Type() string {
+	return "duration"
+}
+
+//Presence of every minion seen since the master started indexed by minion ID, owner is the client
+//the entry was last set by so a stale connection closing doesn't mark a reconnected minion down
+var presence = struct {
+	sync.Mutex
+	minions map[string]*presenceRecord
+}{minions: make(map[string]*presenceRecord)}
+
+type presenceRecord struct {
+	entry datums.PresenceEntry
+	owner *Client
+}
+
+var presenceCmd = &cobra.Command{
+	Use:   "presence [pattern]",
+	Short: "Show which minions are up",
+	Long: `Show whether each minion is up, down or lost.  A minion is lost when it stops sending heartbeats,
+the master disconnects it after --heartbeat-misses heartbeats are missed.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var req datums.PresenceReq
+		if len(args) > 0 {
+			req.Pattern = args[0]
+		}
+		result, err := sendPresenceReq(&req)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if result.Error != "" {
+			fmt.Println(result.Error)
+			os.Exit(1)
+		}
+		printPresence(result.Minions)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(presenceCmd)
+	serveCmd.Flags().Var((*intervalValue)(&heartbeatInterval), "heartbeat-interval", "How often minions are expected to send a heartbeat")
+	serveCmd.Flags().IntVar(&heartbeatMisses, "heartbeat-misses", defaultHeartbeatMisses, "Heartbeats a minion can miss before it is disconnected as lost")
+	clientCmd.Flags().Var((*intervalValue)(&heartbeatInterval), "heartbeat-interval", "How often to send the master a heartbeat")
+}
+
+//Mark a client as up, down or lost.  Only the client that owns the entry can mark it down.
+func setPresence(client *Client, state, reason string) {
+	presence.Lock()
+	defer presence.Unlock()
+	record, ok := presence.minions[client.ID]
+	if !ok {
+		record = &presenceRecord{entry: datums.PresenceEntry{ID: client.ID}}
+		presence.minions[client.ID] = record
+	}
+	if state != datums.PresenceUp && record.owner != client {
+		return
+	}
+	//A lost minion stays lost until it reconnects
+	if state == datums.PresenceDown && record.entry.State == datums.PresenceLost {
+		return
+	}
+	record.owner = client
+	record.entry.Hostname = client.Name
+	if record.entry.State != state {
+		record.entry.Since = time.Now()
+		log.Printf("Minion %s is %s: %s", client.ID, state, reason)
+	}
+	record.entry.State = state
+	record.entry.Reason = reason
+	if state == datums.PresenceUp {
+		record.entry.LastHeartbeat = time.Now()
+	}
+}
+
+//Note a heartbeat from a client
+func (client *Client) heartbeat() {
+	now := time.Now()
+	client.Lock()
+	client.LastHeartbeat = now
+	client.Unlock()
+	presence.Lock()
+	defer presence.Unlock()
+	if record, ok := presence.minions[client.ID]; ok && record.owner == client {
+		record.entry.LastHeartbeat = now
+	}
+}
+
+//Disconnect a client once it has missed too many of the heartbeats agreed on in the hello, stops when
+//done is closed
+func monitorHeartbeats(conn *ssh.ServerConn, client *Client, interval time.Duration, done <-chan struct{}) {
+	limit := interval * time.Duration(heartbeatMisses)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			client.RLock()
+			silent := time.Since(client.LastHeartbeat)
+			client.RUnlock()
+			if silent > limit {
+				setPresence(client, datums.PresenceLost, fmt.Sprintf("no heartbeat for %s", silent.Round(time.Second)))
+				//Closing the connection tears down the client and every job channel
+				conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+//Presence of every minion matching the pattern, authorized minions that haven't connected since the
+//master started are down
+func handlePresenceReq(req *datums.PresenceReq) datums.PresenceResult {
+	entries := make(map[string]datums.PresenceEntry)
+	for _, record := range keyStore.List() {
+		if record.State != datums.KeyStateAuthorized || record.ID == "" {
+			continue
+		}
+		entries[record.ID] = datums.PresenceEntry{
+			ID:            record.ID,
+			Hostname:      record.Hostname,
+			State:         datums.PresenceDown,
+			LastHeartbeat: record.LastSeen,
+		}
+	}
+	presence.Lock()
+	for id, record := range presence.minions {
+		entries[id] = record.entry
+	}
+	presence.Unlock()
+	var result datums.PresenceResult
+	for _, entry := range entries {
+		matched, err := matchPresence(req.Pattern, entry)
+		if err != nil {
+			return datums.PresenceResult{Error: err.Error()}
+		}
+		if matched {
+			result.Minions = append(result.Minions, entry)
+		}
+	}
+	sort.Slice(result.Minions, func(i, j int) bool {
+		return result.Minions[i].ID < result.Minions[j].ID
+	})
+	return result
+}
+
+func matchPresence(pattern string, entry datums.PresenceEntry) (bool, error) {
+	if pattern == "" {
+		return true, nil
+	}
+	for _, name := range []string{entry.ID, entry.Hostname} {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+func sendPresenceReq(req *datums.PresenceReq) (*datums.PresenceResult, error) {
+	c, err := net.Dial("unix", domainSocketAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	err = controlCodec().NewEncoder(c).Encode(&datums.SocketReq{Presence: req})
+	if err != nil {
+		return nil, err
+	}
+	var result datums.PresenceResult
+	err = controlCodec().NewDecoder(c).Decode(&result)
+	if err != nil {
+		return nil, errors.New("no response from server: " + err.Error())
+	}
+	return &result, nil
+}
+
+func printPresence(minions []datums.PresenceEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tID\tHOSTNAME\tSINCE\tLAST HEARTBEAT\tREASON")
+	for _, minion := range minions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", minion.State, minion.ID, minion.Hostname, formatTime(minion.Since), formatTime(minion.LastHeartbeat), minion.Reason)
+	}
+	w.Flush()
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatIntervalFlag(t *testing.T) {
+	for _, arg := range []string{"0", "0s", "-2s", "6m", "often"} {
+		value := intervalValue(defaultHeartbeatInterval)
+		if err := value.Set(arg); err == nil {
+			t.Errorf("--heartbeat-interval %s was accepted", arg)
+		}
+		if time.Duration(value) != defaultHeartbeatInterval {
+			t.Errorf("--heartbeat-interval %s changed the interval to %s", arg, time.Duration(value))
+		}
+	}
+	value := intervalValue(defaultHeartbeatInterval)
+	if err := value.Set("5m"); err != nil || value.String() != "5m0s" {
+		t.Fatalf("got %s, %v", value.String(), err)
+	}
+}
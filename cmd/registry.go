@@ -0,0 +1,133 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+//Registry holds every connected minion indexed by minion ID
+type Registry struct {
+	sync.RWMutex
+	minions map[string]*Client
+}
+
+//Every minion connected to the master
+var registry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{minions: make(map[string]*Client)}
+}
+
+//Add a minion once it has connected and remove it when the connection closes.  The key decides
+//which minion a connection is, so a second connection for a minion that is still connected is the
+//minion coming back after the old connection went stale: the old one is closed and replaced.
+func (registry *Registry) Add(client *Client) {
+	registry.Lock()
+	existing, ok := registry.minions[client.ID]
+	registry.minions[client.ID] = client
+	registry.Unlock()
+	if ok && existing != client {
+		log.Printf("Minion %s reconnected from %s, closing its connection from %s", client.ID, client.IP, existing.IP)
+		if err := existing.Conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	go func() {
+		client.Conn.Wait()
+		registry.Remove(client)
+	}()
+}
+
+//Remove a minion, only the connection that was added can remove it
+func (registry *Registry) Remove(client *Client) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.minions[client.ID] != client {
+		return false
+	}
+	delete(registry.minions, client.ID)
+	return true
+}
+
+func (registry *Registry) Get(id string) (*Client, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	client, ok := registry.minions[id]
+	return client, ok
+}
+
+//Every connected minion using the key
+func (registry *Registry) ByFingerprint(sha string) []*Client {
+	var matched []*Client
+	registry.Each(func(client *Client) {
+		if client.Fingerprint() == sha {
+			matched = append(matched, client)
+		}
+	})
+	return matched
+}
+
+//Every connected minion sorted by ID
+func (registry *Registry) List() []*Client {
+	registry.RLock()
+	list := make([]*Client, 0, len(registry.minions))
+	for _, client := range registry.minions {
+		list = append(list, client)
+	}
+	registry.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+//Call fn with every connected minion in ID order, fn is free to use the registry
+func (registry *Registry) Each(fn func(*Client)) {
+	for _, client := range registry.List() {
+		fn(client)
+	}
+}
+
+//Every minion that has agreed on a protocol and can take jobs
+func (registry *Registry) Ready() []*Client {
+	var ready []*Client
+	registry.Each(func(client *Client) {
+		if client.Ready() {
+			ready = append(ready, client)
+		}
+	})
+	return ready
+}
+
+//Move a minion to the key it rotated to, the connection's permissions keep the key it authenticated with
+func (registry *Registry) Rekey(client *Client, newSha string) {
+	client.Lock()
+	defer client.Unlock()
+	client.KeySha = newSha
+}
+
+//Close every connection using the key, closing the connection closes all of its channels
+func (registry *Registry) CloseFingerprint(sha string) int {
+	matched := registry.ByFingerprint(sha)
+	for _, client := range matched {
+		if err := client.Conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return len(matched)
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	ssh "golang.org/x/crypto/ssh"
+)
+
+//A connection that stays up until it is closed
+type openConn struct {
+	fakeConn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (conn *openConn) Close() error {
+	conn.once.Do(func() { close(conn.closed) })
+	return nil
+}
+
+func (conn *openConn) Wait() error {
+	<-conn.closed
+	return nil
+}
+
+func connectedClient(id, sha string) (*Client, *openConn) {
+	conn := &openConn{fakeConn: fakeConn{fakeConnMeta{user: id, addr: "10.0.0.1:22"}}, closed: make(chan struct{})}
+	perms := &ssh.Permissions{Extensions: map[string]string{"fingerprint": sha}}
+	return &Client{ID: id, KeySha: sha, Conn: &ssh.ServerConn{Conn: conn, Permissions: perms}}, conn
+}
+
+func isClosed(conn *openConn) bool {
+	select {
+	case <-conn.closed:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestRegistryReplacesStaleConnections(t *testing.T) {
+	registry := NewRegistry()
+	stale, staleConn := connectedClient("minion-1", "SHA256:key")
+	registry.Add(stale)
+	fresh, freshConn := connectedClient("minion-1", "SHA256:key")
+	registry.Add(fresh)
+	if !isClosed(staleConn) {
+		t.Fatal("the stale connection is still open")
+	}
+	if client, ok := registry.Get("minion-1"); !ok || client != fresh {
+		t.Fatal("the new connection didn't replace the stale one")
+	}
+	//The stale connection closing doesn't take the new one out
+	if registry.Remove(stale) {
+		t.Fatal("the stale connection removed the new one")
+	}
+	freshConn.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := registry.Get("minion-1"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("closed connection is still registered")
+}
+
+func TestRekeyLeavesTheConnectionAlone(t *testing.T) {
+	registry := NewRegistry()
+	client, conn := connectedClient("minion-1", "SHA256:old")
+	defer conn.Close()
+	registry.Add(client)
+	registry.Rekey(client, "SHA256:new")
+	if client.Fingerprint() != "SHA256:new" {
+		t.Fatalf("fingerprint %s", client.Fingerprint())
+	}
+	if matched := registry.ByFingerprint("SHA256:new"); len(matched) != 1 || matched[0] != client {
+		t.Fatal("the rotated key doesn't find the minion")
+	}
+	if sha := client.Conn.Permissions.Extensions["fingerprint"]; sha != "SHA256:old" {
+		t.Fatalf("the connection's permissions were changed to %s", sha)
+	}
+}
@@ -18,17 +18,35 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/charles-d-burton/hansel/keys"
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+const (
+	passphraseEnv = "HANSEL_PASSPHRASE"
+)
+
+//Version is the build version reported to the master, set with -ldflags "-X github.com/charles-d-burton/hansel/cmd.Version=..."
+var Version = "dev"
+
 var (
-	cfgFile    string
-	privateKey string
-	publicKey  string
-	helpFlag   bool
+	cfgFile           string
+	privateKey        string
+	publicKey         string
+	keyType           string
+	passFile          string
+	agentSock         string
+	helpFlag          bool
+	codecName         string
+	compressionName   string
+	compressThreshold int
+	unlocker          *keys.Unlocker
+	unlockerOnce      sync.Once
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -64,6 +82,18 @@ func init() {
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.hansel.yaml)")
 	rootCmd.PersistentFlags().BoolVarP(&helpFlag, "help", "", false, "Help default flag")
+	rootCmd.PersistentFlags().StringVar(&keyType, "key-type", string(keys.ED25519), "Type of key to generate: ed25519, ecdsa-p256 or rsa-4096")
+	viper.BindPFlag("key-type", rootCmd.PersistentFlags().Lookup("key-type"))
+	rootCmd.PersistentFlags().StringVar(&passFile, "passphrase-file", "", "File holding the passphrase for the private key, "+passphraseEnv+" is used otherwise")
+	viper.BindPFlag("passphrase-file", rootCmd.PersistentFlags().Lookup("passphrase-file"))
+	rootCmd.PersistentFlags().StringVar(&agentSock, "agent-socket", "", "ssh-agent socket holding the private key (default is $SSH_AUTH_SOCK)")
+	viper.BindPFlag("agent-socket", rootCmd.PersistentFlags().Lookup("agent-socket"))
+	rootCmd.PersistentFlags().StringVar(&codecName, "codec", "", "Only speak this codec on the wire (gob, json or protobuf) and log every frame in readable form")
+	viper.BindPFlag("codec", rootCmd.PersistentFlags().Lookup("codec"))
+	rootCmd.PersistentFlags().StringVar(&compressionName, "compression", "", "Only use this compression on the wire (zstd, gzip or none)")
+	viper.BindPFlag("compression", rootCmd.PersistentFlags().Lookup("compression"))
+	rootCmd.PersistentFlags().IntVar(&compressThreshold, "compress-threshold", 4096, "Only compress payloads of at least this many bytes")
+	viper.BindPFlag("compress-threshold", rootCmd.PersistentFlags().Lookup("compress-threshold"))
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -71,6 +101,21 @@ func init() {
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
+	if cfgFile != "" {
+		// Use config file from the flag.
+		viper.SetConfigFile(cfgFile)
+	} else {
+		// Find home directory.
+		home, err := homedir.Dir()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// Search config in home directory with name ".hansel" (without extension).
+		viper.AddConfigPath(home)
+		viper.SetConfigName(".hansel")
+	}
 
 	viper.AutomaticEnv() // read in environment variables that match
 
@@ -81,8 +126,8 @@ func initConfig() {
 }
 
 func setupKeys() error {
-	if _, err := os.Stat("/etc/hansel"); os.IsNotExist(err) {
-		os.Mkdir("/etc/hansel", os.FileMode(0700))
+	if _, err := os.Stat(keyDir); os.IsNotExist(err) {
+		os.Mkdir(keyDir, os.FileMode(0700))
 	}
 	if _, err := os.Stat(configDir); os.IsNotExist(err) {
 		os.Mkdir(configDir, os.FileMode(0700))
@@ -90,13 +135,58 @@ func setupKeys() error {
 	if _, err := os.Stat(runDir); os.IsNotExist(err) {
 		os.Mkdir(runDir, os.FileMode(0700))
 	}
-	privateKey = "/etc/hansel/id_rsa"
-	publicKey = "/etc/hansel/id_rsa.pub"
+	kt, err := keys.ParseKeyType(viper.GetString("key-type"))
+	if err != nil {
+		return err
+	}
+	kt = existingKeyType(kt)
+	privateKey = filepath.Join(keyDir, kt.FileName())
+	publicKey = privateKey + ".pub"
 	log.Println(privateKey)
 	log.Println(publicKey)
-	err := keys.MakeSSHKeyPair(publicKey, privateKey)
+	//New keys are encrypted at rest when a passphrase is configured
+	passphrase, err := keyUnlocker().Passphrase()
+	if err != nil {
+		return err
+	}
+	err = keys.MakeSSHKeyPair(publicKey, privateKey, kt, passphrase)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+//Keep using the key already in the key directory unless --key-type was given, a host upgraded from a
+//build that only made RSA keys would otherwise get a new key nobody trusts
+func existingKeyType(kt keys.KeyType) keys.KeyType {
+	if rootCmd.PersistentFlags().Changed("key-type") || viper.InConfig("key-type") {
+		return kt
+	}
+	candidates := append([]keys.KeyType{kt}, keys.KeyTypes...)
+	for _, candidate := range candidates {
+		if _, err := os.Stat(filepath.Join(keyDir, candidate.FileName())); err == nil {
+			if candidate != kt {
+				log.Printf("Using the existing %s key, pass --key-type %s to switch", candidate, kt)
+			}
+			return candidate
+		}
+	}
+	return kt
+}
+
+//Build the unlocker for encrypted private keys from the flags and environment.  There is one for the
+//whole process so every key unlocked through ssh-agent shares a single connection to it.
+func keyUnlocker() *keys.Unlocker {
+	unlockerOnce.Do(func() {
+		socket := viper.GetString("agent-socket")
+		if socket == "" {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		unlocker = &keys.Unlocker{
+			AgentSocket:    socket,
+			PassphraseFile: viper.GetString("passphrase-file"),
+			PassphraseEnv:  passphraseEnv,
+		}
+	})
+	return unlocker
+}
@@ -0,0 +1,469 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/charles-d-burton/hansel/keys"
+	"github.com/spf13/viper"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+const (
+	//Same request OpenSSH uses to tell clients about every host key the server holds
+	hostKeysRequest = "hostkeys-00@openssh.com"
+	//Sent by the master to have a minion generate its next key
+	rotateKeyRequest = "rotate-key@hansel"
+	//Sent by the master once the minion's next key is authorized
+	commitKeyRequest = "commit-key@hansel"
+
+	rotationStateFile    = "/etc/hansel/rotation"
+	defaultRotationGrace = 24 * time.Hour
+)
+
+//masterRotation is a host key rotation waiting out its grace period, it is kept on disk so a
+//restart doesn't lose it
+type masterRotation struct {
+	Key string `json:"key"`
+	//Target is where the new key is promoted to, it is named for the new key's type so it differs from
+	//Key when --key-type changed.  Rotations started before it was kept promote to Key.
+	Target    string    `json:"target,omitempty"`
+	PromoteAt time.Time `json:"promote_at"`
+}
+
+func (state *masterRotation) target() string {
+	if state.Target == "" {
+		return state.Key
+	}
+	return state.Target
+}
+
+var rotation = struct {
+	sync.Mutex
+	state *masterRotation
+	next  ssh.PublicKey
+	timer *time.Timer
+}{}
+
+//rotateKeyReply is the minion's answer to a rotateKeyRequest
+type rotateKeyReply struct {
+	PubKey    []byte
+	Signature []byte
+}
+
+//hostKeyEntry is a single key in a hostKeysRequest
+type hostKeyEntry struct {
+	Key  []byte
+	Rest []byte `ssh:"rest"`
+}
+
+//Start rotating the master's host key.  The new key is announced to every minion straight away and
+//served next to the old one, the old key is served until the grace period is over so minions that
+//weren't connected in that time can still check it.
+func rotateMasterKey(grace time.Duration) ([]datums.KeyEntry, error) {
+	rotation.Lock()
+	defer rotation.Unlock()
+	if rotation.state != nil {
+		return nil, fmt.Errorf("a rotation of %s is already in progress until %s",
+			rotation.state.Key, rotation.state.PromoteAt.Format(time.RFC3339))
+	}
+	kt, err := keys.ParseKeyType(viper.GetString("key-type"))
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := keyUnlocker().Passphrase()
+	if err != nil {
+		return nil, err
+	}
+	target := filepath.Join(filepath.Dir(privateKey), kt.FileName())
+	next := keys.NextKeyFile(target)
+	keys.RemoveNextKeyPair(target)
+	err = keys.MakeSSHKeyPair(next+".pub", next, kt, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := keys.ReadPublicKey(next + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	err = loadServerConfig(privateKey, next)
+	if err != nil {
+		keys.RemoveNextKeyPair(target)
+		return nil, err
+	}
+	state := &masterRotation{Key: privateKey, Target: target, PromoteAt: time.Now().Add(grace)}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	err = keys.WriteFileAtomic(rotationStateFile, data)
+	if err != nil {
+		return nil, err
+	}
+	rotation.state = state
+	rotation.next = pub
+	rotation.timer = time.AfterFunc(grace, promoteMasterKey)
+	log.Printf("Rotating host key %s to %s, promoting at %s", privateKey, ssh.FingerprintSHA256(pub), state.PromoteAt)
+	for _, client := range registry.List() {
+		go announceHostKeys(client.Conn)
+	}
+	return []datums.KeyEntry{{
+		ID:          "master",
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		State:       datums.KeyStateNext,
+	}}, nil
+}
+
+//The next host key file while a rotation is in progress
+func nextHostKeyFile() string {
+	rotation.Lock()
+	defer rotation.Unlock()
+	if rotation.state == nil {
+		return ""
+	}
+	return keys.NextKeyFile(rotation.state.target())
+}
+
+//Pick up a rotation that was in progress before a restart
+func resumeMasterRotation() error {
+	data, err := ioutil.ReadFile(rotationStateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state masterRotation
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	pub, err := keys.ReadPublicKey(keys.NextKeyFile(state.target()) + ".pub")
+	if err != nil {
+		return err
+	}
+	rotation.Lock()
+	rotation.state = &state
+	rotation.next = pub
+	rotation.timer = time.AfterFunc(time.Until(state.PromoteAt), promoteMasterKey)
+	rotation.Unlock()
+	log.Printf("Resuming rotation of %s, promoting at %s", state.Key, state.PromoteAt)
+	return nil
+}
+
+//Swap the new host key in once the grace period is over, connections that are already up aren't affected
+func promoteMasterKey() {
+	rotation.Lock()
+	defer rotation.Unlock()
+	if rotation.state == nil {
+		return
+	}
+	target, err := promoteHostKeyFiles(rotation.state)
+	if err != nil {
+		log.Println("Failed to promote host key ", err)
+		return
+	}
+	privateKey, publicKey = target, target+".pub"
+	err = loadServerConfig(privateKey, "")
+	if err != nil {
+		log.Println("Failed to load promoted host key ", err)
+		return
+	}
+	if err := os.Remove(rotationStateFile); err != nil {
+		log.Println(err)
+	}
+	log.Println("Promoted host key ", target, ssh.FingerprintSHA256(rotation.next))
+	rotation.state = nil
+	rotation.next = nil
+	rotation.timer = nil
+}
+
+//Move the next key pair in place of the one it replaces and return the new key's file
+func promoteHostKeyFiles(state *masterRotation) (string, error) {
+	target := state.target()
+	if err := keys.PromoteKeyPair(target+".pub", target); err != nil {
+		return "", err
+	}
+	//A key of another type would be served for good next to the new one, it is retired the same way
+	//PromoteKeyPair retires a key it replaces
+	if target != state.Key {
+		for _, file := range []string{state.Key, state.Key + ".pub"} {
+			if err := os.Rename(file, file+".old"); err != nil {
+				return "", err
+			}
+		}
+	}
+	return target, nil
+}
+
+//Tell a client about the host keys it should trust, only while a rotation is in progress.  The request
+//comes over a connection authenticated with a pinned key so the client can trust what's in it.
+func announceHostKeys(conn ssh.Conn) {
+	rotation.Lock()
+	next := rotation.next
+	rotation.Unlock()
+	if next == nil {
+		return
+	}
+	hostConfig.RLock()
+	hostKeys := append([]ssh.PublicKey{next}, hostConfig.keys...)
+	hostConfig.RUnlock()
+	var payload []byte
+	for i, key := range hostKeys {
+		//The next key is among the served keys while the rotation is on
+		if i > 0 && bytes.Equal(key.Marshal(), next.Marshal()) {
+			continue
+		}
+		payload = append(payload, ssh.Marshal(hostKeyEntry{Key: key.Marshal()})...)
+	}
+	_, _, err := conn.SendRequest(hostKeysRequest, false, payload)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//Rotate the key of every connected minion that matches the request, minions that aren't connected
+//are rotated the next time they are asked while connected
+func rotateMinionKeys(req *datums.KeyReq) ([]datums.KeyEntry, error) {
+	var (
+		rotated []datums.KeyEntry
+		failed  []string
+	)
+	seen := make(map[string]bool)
+	for _, client := range registry.List() {
+		entry := datums.KeyEntry{
+			ID:          client.ID,
+			Hostname:    client.Name,
+			Fingerprint: client.Fingerprint(),
+		}
+		if seen[entry.Fingerprint] || !matchUser(req, entry) {
+			continue
+		}
+		seen[entry.Fingerprint] = true
+		//The certificate is bound to the old key, a new one has to be signed instead
+		if client.Conn.Permissions.Extensions["admitted"] == "ca" {
+			failed = append(failed, entry.ID+": admitted by certificate")
+			continue
+		}
+		newSha, err := rotateMinionKey(client)
+		if err != nil {
+			log.Printf("Failed to rotate key of %s: %v", entry.ID, err)
+			failed = append(failed, entry.ID+": "+err.Error())
+			continue
+		}
+		log.Printf("Rotated key of %s from %s to %s", entry.ID, entry.Fingerprint, newSha)
+		entry.Fingerprint = newSha
+		entry.State = datums.KeyStateAuthorized
+		rotated = append(rotated, entry)
+	}
+	if len(failed) > 0 {
+		return rotated, errors.New("failed to rotate " + strings.Join(failed, ", "))
+	}
+	return rotated, nil
+}
+
+//Have a minion generate a new key and swap it in for the old one.  The request goes over the
+//connection the old key authenticated, the minion proves it holds the new key by signing a nonce
+//bound to the session.
+func rotateMinionKey(client *Client) (string, error) {
+	conn := client.Conn
+	nonce := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	ok, payload, err := conn.SendRequest(rotateKeyRequest, true, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("minion refused to rotate")
+	}
+	var reply rotateKeyReply
+	if err := ssh.Unmarshal(payload, &reply); err != nil {
+		return "", err
+	}
+	pub, err := ssh.ParsePublicKey(reply.PubKey)
+	if err != nil {
+		return "", err
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(reply.Signature, &sig); err != nil {
+		return "", err
+	}
+	if err := pub.Verify(keys.RotationProof(conn.SessionID(), nonce), &sig); err != nil {
+		return "", errors.New("proof of possession failed: " + err.Error())
+	}
+	sha := client.Fingerprint()
+	newSha := ssh.FingerprintSHA256(pub)
+	if err := replaceUserKey(conn.User(), sha, pub); err != nil {
+		return "", err
+	}
+	registry.Rekey(client, newSha)
+	//The minion picks the new key up on its next connect even if this is lost
+	ok, _, err = conn.SendRequest(commitKeyRequest, true, []byte(newSha))
+	if err != nil {
+		return newSha, err
+	}
+	if !ok {
+		return newSha, errors.New("minion failed to promote the new key")
+	}
+	return newSha, nil
+}
+
+//Handle the global requests the master sends to a minion
+func (server *Server) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case hostKeysRequest:
+			server.pinHostKeys(req.Payload)
+		case rotateKeyRequest:
+			reply, err := prepareNextKey(server.Conn.SessionID(), req.Payload)
+			if err != nil {
+				log.Println("Failed to generate next key ", err)
+			}
+			req.Reply(err == nil, reply)
+		case commitKeyRequest:
+			err := keys.PromoteKeyPair(publicKey, privateKey)
+			if err != nil {
+				log.Println("Failed to promote next key ", err)
+			} else {
+				log.Println("Rotated key to ", string(req.Payload))
+			}
+			req.Reply(err == nil, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+//Pin every host key the master announced that isn't already pinned
+func (server *Server) pinHostKeys(payload []byte) {
+	hostname := *server.Host + ":" + *server.Port
+	pinned, err := keys.PinnedKeys(masterPinFile, hostname)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	known := make(map[string]bool)
+	for _, key := range pinned {
+		known[key.Fingerprint] = true
+	}
+	for len(payload) > 0 {
+		var entry hostKeyEntry
+		if err := ssh.Unmarshal(payload, &entry); err != nil {
+			log.Println(err)
+			return
+		}
+		payload = entry.Rest
+		pub, err := ssh.ParsePublicKey(entry.Key)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sha := ssh.FingerprintSHA256(pub)
+		if known[sha] {
+			continue
+		}
+		log.Printf("Pinning announced host key for %s: %s", hostname, sha)
+		if err := keys.PinKey(masterPinFile, hostname, keys.PinnedKey{Fingerprint: sha, Type: pub.Type()}); err != nil {
+			log.Println(err)
+			return
+		}
+		known[sha] = true
+	}
+}
+
+//Generate the next key pair and sign the master's nonce with it, the current key stays in use until
+//the master commits the rotation
+func prepareNextKey(sessionID, nonce []byte) ([]byte, error) {
+	if len(nonce) == 0 {
+		return nil, errors.New("no nonce to sign")
+	}
+	kt, err := keys.ParseKeyType(viper.GetString("key-type"))
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := keyUnlocker().Passphrase()
+	if err != nil {
+		return nil, err
+	}
+	next := keys.NextKeyFile(privateKey)
+	keys.RemoveNextKeyPair(privateKey)
+	err = keys.MakeSSHKeyPair(next+".pub", next, kt, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := keyUnlocker().Signer(next)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(rand.Reader, keys.RotationProof(sessionID, nonce))
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(rotateKeyReply{
+		PubKey:    signer.PublicKey().Marshal(),
+		Signature: ssh.Marshal(sig),
+	}), nil
+}
+
+//usedSigner records whether a key was used, the client only signs with a key the server has accepted
+type usedSigner struct {
+	ssh.Signer
+	used bool
+}
+
+func (signer *usedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer.used = true
+	return signer.Signer.Sign(rand, data)
+}
+
+//Promote the next key left over from an interrupted rotation if the master accepted it, otherwise
+//the master never authorized it and it is thrown away
+func finishRotation(accepted bool) {
+	if !accepted {
+		log.Println("Master did not accept the next key, discarding it")
+		keys.RemoveNextKeyPair(privateKey)
+		return
+	}
+	if err := keys.PromoteKeyPair(publicKey, privateKey); err != nil {
+		log.Println("Failed to promote next key ", err)
+		return
+	}
+	log.Println("Master accepted the next key, promoted it")
+}
+
+//Global requests are handled by the Server, the ssh.Client gets a channel with nothing on it
+func closedRequests() <-chan *ssh.Request {
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+	return reqs
+}
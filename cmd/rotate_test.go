@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/charles-d-burton/hansel/keys"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+func makeHostKey(t *testing.T, file string, kt keys.KeyType) ssh.PublicKey {
+	if err := keys.MakeSSHKeyPair(file+".pub", file, kt, nil); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := keys.ReadPublicKey(file + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func hasKey(served []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, pub := range served {
+		if bytes.Equal(pub.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoadHostKeysServesTheNextKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	current := filepath.Join(dir, keys.ED25519.FileName())
+	old := makeHostKey(t, current, keys.ED25519)
+
+	//A new key of another type is served next to the old one
+	next := keys.NextKeyFile(filepath.Join(dir, keys.ECDSAP256.FileName()))
+	nextPub := makeHostKey(t, next, keys.ECDSAP256)
+	served, err := loadHostKeys(&ssh.ServerConfig{}, current, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 2 || !hasKey(served, old) || !hasKey(served, nextPub) {
+		t.Fatalf("served %d keys, want the old and the next key", len(served))
+	}
+
+	//SSH serves one key per type, minions that missed the announcement only trust the old one
+	sameType := keys.NextKeyFile(current)
+	makeHostKey(t, sameType, keys.ED25519)
+	served, err = loadHostKeys(&ssh.ServerConfig{}, current, sameType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || !hasKey(served, old) {
+		t.Fatalf("served %d keys, want only the old key", len(served))
+	}
+}
+
+func TestPromoteHostKeyToAnotherType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	current := filepath.Join(dir, keys.ECDSAP256.FileName())
+	makeHostKey(t, current, keys.ECDSAP256)
+	target := filepath.Join(dir, keys.ED25519.FileName())
+	nextPub := makeHostKey(t, keys.NextKeyFile(target), keys.ED25519)
+
+	promoted, err := promoteHostKeyFiles(&masterRotation{Key: current, Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted != target {
+		t.Fatalf("promoted to %s, want %s", promoted, target)
+	}
+	pub, err := keys.ReadPublicKey(target + ".pub")
+	if err != nil || !bytes.Equal(pub.Marshal(), nextPub.Marshal()) {
+		t.Fatalf("%s doesn't hold the new key: %v", target, err)
+	}
+	if _, err := os.Stat(current); !os.IsNotExist(err) {
+		t.Fatal("the old key is still in place to be served")
+	}
+	if _, err := os.Stat(current + ".old"); err != nil {
+		t.Fatal(err)
+	}
+	served, err := loadHostKeys(&ssh.ServerConfig{}, promoted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || !hasKey(served, nextPub) {
+		t.Fatalf("served %d keys after the promotion, want only the new key", len(served))
+	}
+}
+
+//A rotation started before the target was kept promotes to the key it started from
+func TestPromoteHostKeyWithoutTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	current := filepath.Join(dir, keys.ED25519.FileName())
+	makeHostKey(t, current, keys.ED25519)
+	nextPub := makeHostKey(t, keys.NextKeyFile(current), keys.ED25519)
+	promoted, err := promoteHostKeyFiles(&masterRotation{Key: current})
+	if err != nil || promoted != current {
+		t.Fatalf("promoted to %s, %v", promoted, err)
+	}
+	pub, err := keys.ReadPublicKey(current + ".pub")
+	if err != nil || !bytes.Equal(pub.Marshal(), nextPub.Marshal()) {
+		t.Fatalf("%s doesn't hold the new key: %v", current, err)
+	}
+}
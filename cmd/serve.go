@@ -15,9 +15,6 @@
 package cmd
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
@@ -28,6 +25,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/charles-d-burton/hansel/datums"
 	"github.com/charles-d-burton/hansel/keys"
@@ -37,43 +35,56 @@ import (
 )
 
 const (
-	authorizedFile   = "/var/lib/authorized_users"
-	pendingFile      = "/var/lib/pending_users"
+	keyStoreFile     = "/var/lib/minion_keys"
+	tokensFile       = "/var/lib/bootstrap_tokens"
 	configDir        = "/var/lib/hansel/"
+	keyDir           = "/etc/hansel/"
 	runDir           = "/var/run/hansel/"
 	domainSocketAddr = "/var/run/hansel/hansel.sock"
+
+	//The user=sha files the key store replaced, they are imported on first start
+	authorizedFile = "/var/lib/authorized_users"
+	pendingFile    = "/var/lib/pending_users"
+	rejectedFile   = "/var/lib/rejected_users"
+	revokedFile    = "/var/lib/revoked_users"
 )
 
 var (
 	Port     string
 	CFLocker *ConfigFileLocker
 	maxFile  = (1024 * 1024)
-	clients  = make([]*Client, 100)
 )
 
 //RemoteHost represents a Host Object with send and receive channels
 type Client struct {
 	sync.RWMutex
+	ID       string
 	Name     string
 	IP       net.Addr
 	KeySha   string
+	Conn     *ssh.ServerConn
 	Channel  ssh.Channel
 	Controls struct {
 		Timer int
 	}
 	Stop chan bool
 	Send chan datums.ServerMessage
+	//What was agreed on in the hello exchange
+	Protocol      *datums.HelloAck
+	LastHeartbeat time.Time
+	//What the minion is targeted by, labels the master assigned are known before it reports its facts
+	Labels map[string]string
+	Facts  map[string]string
+}
+
+//LockedFile guards a single config file on disk
+type LockedFile struct {
+	sync.RWMutex
+	ConfigFile string
 }
 
 type ConfigFileLocker struct {
-	AuthorizedUsers struct {
-		sync.RWMutex
-		ConfigFile string
-	}
-	PendingUsers struct {
-		sync.RWMutex
-		ConfigFile string
-	}
+	BootstrapTokens LockedFile
 }
 
 // serveCmd represents the serve command
@@ -87,7 +98,16 @@ var serveCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal(err)
 		}
-		cfgFiles, err := setupConfigFiles(authorizedFile, pendingFile)
+		keyStore, err = openKeyStore(keyStoreFile, []legacyUserFile{
+			{authorizedFile, datums.KeyStateAuthorized},
+			{rejectedFile, datums.KeyStateRejected},
+			{pendingFile, datums.KeyStatePending},
+			{revokedFile, datums.KeyStateRevoked},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfgFiles, err := setupConfigFiles(tokensFile)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -95,6 +115,10 @@ var serveCmd = &cobra.Command{
 			log.Fatal(errors.New("Unable to initialize config files"))
 		}
 		CFLocker = cfgFiles
+		err = loadUserCA(caPublicKey)
+		if err != nil {
+			log.Fatal(err)
+		}
 		go listenAndServeDomain()
 		listenAndServeSSH(privateKey)
 	},
@@ -114,16 +138,22 @@ func init() {
 	// serveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+//The config new connections are handshaked with, it is replaced when the host key is rotated
+var hostConfig = struct {
+	sync.RWMutex
+	config *ssh.ServerConfig
+	keys   []ssh.PublicKey
+}{}
+
 func listenAndServeSSH(privateKeyFile string) {
-	signer, err := keys.PrivateKeySigner(privateKeyFile)
+	err := resumeMasterRotation()
 	if err != nil {
-		log.Println(err)
+		log.Fatal(err)
 	}
-	config := &ssh.ServerConfig{
-		NoClientAuth:      false,
-		PublicKeyCallback: validatePubKey,
+	err = loadServerConfig(privateKeyFile, nextHostKeyFile())
+	if err != nil {
+		log.Fatal(err)
 	}
-	config.AddHostKey(*signer)
 	listener, err := net.Listen("tcp", ":"+Port)
 	if err != nil {
 		log.Fatal(err)
@@ -135,6 +165,9 @@ func listenAndServeSSH(privateKeyFile string) {
 			log.Println(err)
 			continue
 		}
+		hostConfig.RLock()
+		config := hostConfig.config
+		hostConfig.RUnlock()
 		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
 		if err != nil {
 			log.Println("Failed to handshake ", err)
@@ -142,28 +175,148 @@ func listenAndServeSSH(privateKeyFile string) {
 		}
 		log.Printf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
 		client := &Client{
-			IP: sshConn.RemoteAddr(),
+			ID:     sshConn.User(),
+			Name:   minionHostname(sshConn),
+			IP:     sshConn.RemoteAddr(),
+			KeySha: sshConn.Permissions.Extensions["fingerprint"],
+			Conn:   sshConn,
 		}
-		log.Println(client)
+		log.Printf("Minion %s (%s) connected with key %s", client.ID, client.Name, client.KeySha)
+		//The key may have been revoked while the handshake was finishing
+		if isKeyRevoked(client.KeySha) {
+			log.Println("Closing connection for revoked key: ", client.KeySha)
+			sshConn.Close()
+			continue
+		}
+		if legacy := sshConn.Permissions.Extensions["adopt"]; legacy != "" {
+			if err := adoptMinionID(client.ID, client.KeySha, legacy); err != nil {
+				log.Println("Closing connection: ", err)
+				sshConn.Close()
+				continue
+			}
+		}
+		admitted := sshConn.Permissions.Extensions["admitted"]
+		//Keys nobody has decided on are queued for an operator, the minion can't do anything yet
+		if admitted == "pending" {
+			if err := markUserPending(sshConn); err != nil {
+				log.Println(err)
+			}
+			log.Printf("Closing connection for %s, its key is pending", client.ID)
+			sshConn.Close()
+			continue
+		}
+		//Only authorize a key admitted by token or policy once the handshake has proven the client holds it
+		if admitted == "token" {
+			if err := redeemToken(sshConn); err != nil {
+				log.Println("Closing connection: ", err)
+				sshConn.Close()
+				continue
+			}
+		}
+		switch admitted {
+		case "token", "policy":
+			labels := datums.ParseLabels(sshConn.Permissions.Extensions["labels"])
+			if err := authorizeUser(sshConn, labels, sshConn.Permissions.Extensions["admitted_by"]); err != nil {
+				log.Println(err)
+			}
+		}
+		registry.Add(client)
+		if err := recordSeen(sshConn); err != nil {
+			log.Println(err)
+		}
+		//Labels from the token the minion was admitted with count straight away
+		if record, ok := keyStore.Get(client.ID); ok {
+			client.Lock()
+			client.Labels = record.Labels
+			client.Unlock()
+		}
+		//Let the client pin the next host key before the old one goes away
+		go announceHostKeys(sshConn)
 		go ssh.DiscardRequests(reqs)
-		go handleChannels(chans)
+		go handleChannels(client, chans)
+	}
+}
+
+//Build the config for new connections from the host keys on disk
+func loadServerConfig(privateKeyFile, nextKeyFile string) error {
+	config := &ssh.ServerConfig{
+		NoClientAuth:                false,
+		PublicKeyCallback:           validatePubKey,
+		KeyboardInteractiveCallback: validateToken,
+	}
+	hostKeys, err := loadHostKeys(config, privateKeyFile, nextKeyFile)
+	if err != nil {
+		return err
+	}
+	hostConfig.Lock()
+	hostConfig.config = config
+	hostConfig.keys = hostKeys
+	hostConfig.Unlock()
+	return nil
+}
+
+//Advertise the primary host key along with any other type found in the key directory,
+//clients pinned to an older key type keep working after the key type is changed.  The next key of a
+//rotation is served too unless a key of its type is, SSH only serves one key per type and minions
+//that missed the announcement only trust the old one.
+func loadHostKeys(config *ssh.ServerConfig, privateKeyFile, nextKeyFile string) ([]ssh.PublicKey, error) {
+	files := []string{privateKeyFile}
+	for _, kt := range keys.KeyTypes {
+		file := filepath.Join(filepath.Dir(privateKeyFile), kt.FileName())
+		if file == privateKeyFile {
+			continue
+		}
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	if nextKeyFile != "" {
+		files = append(files, nextKeyFile)
+	}
+	var hostKeys []ssh.PublicKey
+	served := make(map[string]bool)
+	unlocker := keyUnlocker()
+	for _, file := range files {
+		signer, err := keys.PrivateKeySigner(file, unlocker)
+		if err != nil && file == privateKeyFile {
+			return nil, err
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		//AddHostKey would replace the key of the same type that is already served
+		keyType := (*signer).PublicKey().Type()
+		if served[keyType] {
+			log.Printf("Not serving host key %s, a %s key is served already", file, keyType)
+			continue
+		}
+		served[keyType] = true
+		log.Println("Loaded host key ", file, ssh.FingerprintSHA256((*signer).PublicKey()))
+		config.AddHostKey(*signer)
+		hostKeys = append(hostKeys, (*signer).PublicKey())
 	}
+	return hostKeys, nil
 }
 
-func handleChannels(chans <-chan ssh.NewChannel) {
+func handleChannels(client *Client, chans <-chan ssh.NewChannel) {
 	for newChannel := range chans {
-		go handleChannel(newChannel)
+		go handleChannel(client, newChannel)
 	}
 }
 
-func handleChannel(newChannel ssh.NewChannel) {
-	var client Client
+//Run the control channel of a minion, a minion only gets one
+func handleChannel(client *Client, newChannel ssh.NewChannel) {
+	conn := client.Conn
 	client.Lock()
-	defer client.Close()
-	defer client.Unlock()
-
+	if client.Channel != nil {
+		client.Unlock()
+		newChannel.Reject(ssh.ResourceShortage, "minion already has a control channel")
+		return
+	}
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
+		client.Unlock()
 		log.Printf("could not accept channel (%s)", err)
 		return
 	}
@@ -173,65 +326,169 @@ func handleChannel(newChannel ssh.NewChannel) {
 	log.Printf("open channel [%s] '%s'", chanType, extraData)
 	//Setup the client
 	client.Channel = channel
-	clients = append(clients, &client)
 	client.Stop = make(chan bool, 1)
 	client.Send = make(chan datums.ServerMessage, 100)
 	client.Unlock()
+	defer client.Close()
 
-	go readFromRemote(channel)
 	//requests must be serviced
 	go ssh.DiscardRequests(requests)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	//watch for messages or a stop
-	select {
-	case message := <-client.Send:
-		log.Println("Got message to publish: ", message)
-		err := enc.Encode(&message)
-		if err != nil {
-			log.Println(err)
-		}
-		_, err = channel.Write(buf.Bytes())
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		buf.Reset()
-	case <-client.Stop:
+	stream := newWireStream(channel)
+	protocol, first, err := negotiate(conn, stream)
+	if err != nil {
+		log.Println(err)
 		return
 	}
+	//Only take jobs once the protocol is agreed on
+	client.heartbeat()
+	client.Lock()
+	client.Protocol = protocol
+	client.Unlock()
+	setPresence(client, datums.PresenceUp, "connected")
+	done := make(chan struct{})
+	go monitorHeartbeats(conn, client, protocol.HeartbeatInterval, done)
+	defer func() {
+		close(done)
+		setPresence(client, datums.PresenceDown, "disconnected")
+	}()
+	if first != nil {
+		handleClientEnvelope(client, stream, first)
+	}
+	go readFromRemote(client, stream)
 
 	configs, err := marshalConfigs(configDir)
 	if err != nil {
 		log.Println(err)
-		return
 	}
 	for _, config := range configs {
+		//Don't send a minion modules it doesn't have
+		if config.Type != "" && !protocol.HasModule(config.Type) {
+			log.Printf("Skipping %s config for %s", config.Type, client.ID)
+			continue
+		}
+		config.JID = startJob([]string{client.ID}, false).JID
 		log.Println("Got configs to send")
 		log.Println(config)
-		err := enc.Encode(&config)
+		err := client.dispatch(conn, stream, config)
 		if err != nil {
 			log.Println(err)
+			return
+		}
+	}
+	//watch for messages or a stop
+	for {
+		select {
+		case message := <-client.Send:
+			log.Println("Got message to publish: ", message)
+			err := client.dispatch(conn, stream, message)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		case <-client.Stop:
+			return
 		}
-		channel.Write(buf.Bytes())
-		buf.Reset()
 	}
 }
 
-//Validate that the provided user and key are valid
+//Send a job to the client, on its own channel when the client supports it
+func (client *Client) dispatch(conn *ssh.ServerConn, stream *wireStream, message datums.ServerMessage) error {
+	if client.Protocol.Version >= jobChannelVersion {
+		go runJobChannel(conn, client, message)
+		return nil
+	}
+	return stream.write(message, "")
+}
+
+//A client can take jobs once it has agreed on a protocol
+func (client *Client) Ready() bool {
+	client.RLock()
+	defer client.RUnlock()
+	return client.Protocol != nil
+}
+
+//The fingerprint of the key the client is using now
+func (client *Client) Fingerprint() string {
+	client.RLock()
+	defer client.RUnlock()
+	return client.KeySha
+}
+
+//Validate that the provided user and key are valid.  ssh calls this for queries as well as signed
+//requests, so it only looks things up, the store is written once the handshake has succeeded.
 func validatePubKey(connMeta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-	valid, err := isUserValid(connMeta.User(), ssh.FingerprintSHA256(key))
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return validateCert(connMeta, cert)
+	}
+	sha := ssh.FingerprintSHA256(key)
+	if isKeyRevoked(sha) {
+		log.Println("Refusing revoked key: ", sha)
+		return nil, errors.New("Key has been revoked")
+	}
+	if err := validateMinionID(connMeta.User()); err != nil {
+		return nil, err
+	}
+	legacy, err := claimMinionID(connMeta, sha)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Refusing key: ", err)
+		return nil, errors.New("Key does not belong to this minion")
 	}
-	if valid {
-		return nil, nil
+	record := connMeta.User()
+	if legacy != "" {
+		record = legacy
 	}
-	err = markUserPending(connMeta.User(), ssh.FingerprintSHA256(key))
+	perms, err := admitKey(connMeta, key, record)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return nil, errors.New("User is not valid")
+	//A record still kept under the hostname moves to the minion's ID after the handshake
+	if legacy != "" {
+		perms.Extensions["adopt"] = legacy
+	}
+	return perms, nil
+}
+
+//Decide how a key that isn't revoked and belongs to the minion gets in, record is where its key is kept
+func admitKey(connMeta ssh.ConnMetadata, key ssh.PublicKey, record string) (*ssh.Permissions, error) {
+	sha := ssh.FingerprintSHA256(key)
+	if isUserValid(record, sha) {
+		return keyPermissions(key, nil), nil
+	}
+	if isUserRejected(record, sha) {
+		log.Println("Refusing rejected user: ", connMeta.User())
+		return nil, errors.New("User has been rejected")
+	}
+	if perms := redeemTokenGrant(connMeta, key); perms != nil {
+		return perms, nil
+	}
+	action, rule := evaluatePolicy(connMeta, sha)
+	switch action {
+	case PolicyAccept:
+		//Authorized after the handshake proves the client holds the key
+		return keyPermissions(key, map[string]string{
+			"admitted":    "policy",
+			"admitted_by": "policy " + rule,
+		}), nil
+	case PolicyReject:
+		return nil, errors.New("User rejected by policy")
+	}
+	//Let the handshake finish so the key is queued only once the client has proven it holds it, the
+	//connection is closed straight after
+	return keyPermissions(key, map[string]string{"admitted": "pending"}), nil
+}
+
+//Permissions for an admitted key, the public key is carried through to be recorded after the handshake
+func keyPermissions(key ssh.PublicKey, extensions map[string]string) *ssh.Permissions {
+	perms := &ssh.Permissions{
+		Extensions: map[string]string{
+			"fingerprint": ssh.FingerprintSHA256(key),
+			"public_key":  marshalPublicKey(key),
+		},
+	}
+	for k, v := range extensions {
+		perms.Extensions[k] = v
+	}
+	return perms
 }
 
 //Setup the configs
@@ -242,90 +499,120 @@ func setupConfigFiles(configs ...string) (*ConfigFileLocker, error) {
 		if err != nil {
 			return nil, err
 		}
-		if configFile == authorizedFile {
-			cfFlocker.AuthorizedUsers.ConfigFile = cfgFile
-		}
-		if configFile == pendingFile {
-			cfFlocker.PendingUsers.ConfigFile = cfgFile
+		if configFile == tokensFile {
+			cfFlocker.BootstrapTokens.ConfigFile = configFile
 		}
 	}
 	return &cfFlocker, nil
 }
 
-//TODO: implement some kind of EOM marker and publish the message to a queue that prints them in sequence with client info
-//Read data returned from the client
-func readFromRemote(channel ssh.Channel) {
-	var clientMessage datums.ClientMessage
-	log.Println("Reading channel")
-	dec := gob.NewDecoder(channel)
-	for {
-		err := dec.Decode(&clientMessage)
-		if err != nil {
-			log.Println("Failed reading from channel", err)
-			//return
-		}
-		log.Println("Received status from: ", clientMessage.GetClientInfo().Name)
-		for _, result := range clientMessage.GetResults() {
-			log.Println(result)
-		}
-
+//Wait for the minion's hello and answer it with what both sides will use.  A minion that starts
+//talking without a hello is an older build, it gets the first protocol version and the message it
+//sent is handed back to be dispatched.
+func negotiate(conn *ssh.ServerConn, stream *wireStream) (*datums.HelloAck, *datums.Envelope, error) {
+	codecs, err := wireCodecs()
+	if err != nil {
+		return nil, nil, err
 	}
-}
-
-//Check if a user is in the authorized keys file
-func isUserValid(user, sha string) (bool, error) {
-	CFLocker.AuthorizedUsers.Lock()
-	defer CFLocker.AuthorizedUsers.Unlock()
-	file, err := os.OpenFile(CFLocker.AuthorizedUsers.ConfigFile, os.O_APPEND|os.O_RDWR, 0600)
-	defer file.Close()
+	compression, err := wireCompression()
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	log.Println("Checking for validity: ")
-	return lookForUser(file, user, sha)
-}
-
-//Create a new user and mark it as pending TODO: move with user management and also increase uniqueness(client side?)
-func markUserPending(user, sha string) error {
-	CFLocker.PendingUsers.Lock()
-	defer CFLocker.PendingUsers.Unlock()
-	file, err := os.OpenFile(CFLocker.PendingUsers.ConfigFile, os.O_APPEND|os.O_RDWR, 0600)
-	defer file.Close()
+	env, err := stream.read()
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	userPending, err := lookForUser(file, user, sha)
+	hello := datums.LegacyHello()
+	var first *datums.Envelope
+	if env.Kind == datums.KindHello {
+		payload, err := stream.open(env)
+		if err != nil {
+			stream.write(&datums.ErrorMessage{Message: err.Error()}, env.ID)
+			return nil, nil, err
+		}
+		hello = payload.(*datums.Hello)
+	} else {
+		first = env
+	}
+	ack, err := hello.Negotiate(Version, codecs, compression)
 	if err != nil {
-		log.Fatal(err)
+		stream.write(&datums.ErrorMessage{Message: err.Error()}, env.ID)
+		return nil, nil, fmt.Errorf("refusing minion %s: %v", conn.User(), err)
 	}
-	if !userPending {
-		log.Println("User not found, marking pending")
-		if _, err := file.WriteString(user + "=" + sha + "\n"); err != nil {
-			log.Fatal(err)
+	ack.HeartbeatInterval = hello.Heartbeat(heartbeatInterval)
+	if first == nil {
+		err = stream.write(ack, env.ID)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
-	return nil
+	err = stream.agree(ack)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Minion %s build %q speaks protocol %d with %s/%s and a heartbeat every %s", conn.User(), hello.BuildVersion, ack.Version, ack.Codec, ack.Compression, ack.HeartbeatInterval)
+	if err := recordHello(conn, hello, ack); err != nil {
+		log.Println(err)
+	}
+	return ack, first, nil
 }
 
-//Search the provided file for a user TODO: User management should be a separate package
-func lookForUser(file *os.File, user, sha string) (bool, error) {
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		fmt.Println(user)
-		userAndKey := strings.Split(line, "=")
-		if strings.Compare(strings.TrimSpace(userAndKey[0]), strings.TrimSpace(user)) == 0 {
-			log.Println("User matches, checking sha")
-			if strings.Compare(strings.TrimSpace(userAndKey[1]), strings.TrimSpace(sha)) == 0 {
-				return true, nil
+//TODO: publish the messages to a queue that prints them in sequence with client info
+//Read envelopes returned from the client
+func readFromRemote(client *Client, stream *wireStream) {
+	log.Println("Reading channel")
+	for {
+		env, err := stream.read()
+		if err != nil {
+			log.Println("Failed reading from channel", err)
+			//Stop sending to a client that has gone away
+			select {
+			case client.Stop <- true:
+			default:
 			}
+			return
 		}
+		handleClientEnvelope(client, stream, env)
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+//Dispatch a message from the client by its kind
+func handleClientEnvelope(client *Client, stream *wireStream, env *datums.Envelope) {
+	payload, err := stream.open(env)
+	if err != nil {
+		log.Println("Dropping message ", env.ID, err)
+		return
+	}
+	switch message := payload.(type) {
+	case *datums.ClientStatus:
+		client.heartbeat()
+	case *datums.Facts:
+		log.Printf("Minion %s reported %d labels and %d facts", client.ID, len(message.Labels), len(message.Facts))
+		client.setFacts(message)
+	case *datums.OutputChunk:
+		log.Printf("%s [%d] %s: %s", client.ID, message.Index, message.Stream, strings.TrimRight(message.Data, "\n"))
+		message.ID = client.ID
+		message.Name = client.Name
+		recordJobOutput(client.ID, message)
+	case *datums.ClientResult:
+		log.Printf("Received result for job %s from: %s", message.JID, client.ID)
+		for _, action := range message.Actions {
+			log.Println(action.Output)
+		}
+		//The minion is who authenticated, not who the result claims to be from
+		message.ID = client.ID
+		message.Name = client.Name
+		recordJobResult(client.ID, message)
+	case datums.ClientMessage:
+		log.Printf("Received %s from: %s", env.Kind, message.GetClientInfo().Name)
+		for _, result := range message.GetResults() {
+			log.Println(result)
+		}
+	case *datums.ErrorMessage:
+		log.Printf("Client failed to handle %s: %s", env.CorrelationID, message.Message)
+	default:
+		log.Printf("Unexpected %s message from client", env.Kind)
 	}
-	return false, nil
 }
 
 //Validate that a config exists in the requested directory
@@ -390,9 +677,11 @@ func marshalConfigs(configDir string) ([]*datums.CommandRunner, error) {
 	return messages, nil
 }
 
-//Close client connection
+//Close client connection, a minion without its control channel can't do anything so the whole
+//connection goes with it
 func (client *Client) Close() {
 	client.Channel.Close()
+	client.Conn.Close()
 }
 
 func handleSigIntKill() chan os.Signal {
@@ -0,0 +1,147 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/charles-d-burton/hansel/target"
+)
+
+//Find the connected minions a control request targets.  Minions named in a list that aren't
+//connected are returned as offline so they can be told apart from minions that don't answer.
+func matchTargets(req *datums.ControllerReq) ([]*Client, []string, error) {
+	expr, names, err := targetExpr(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	ready := registry.Ready()
+	var targets []*Client
+	for _, client := range ready {
+		if expr.Match(client.targetMinion()) {
+			targets = append(targets, client)
+		}
+	}
+	var offline []string
+	for _, name := range names {
+		if !anyMatch(target.List(name), ready) {
+			offline = append(offline, name)
+		}
+	}
+	return targets, offline, nil
+}
+
+//Build the expression a control request targets with, the names given in a list are returned too
+func targetExpr(req *datums.ControllerReq) (target.Expr, []string, error) {
+	var (
+		hosts  target.Expr
+		names  []string
+		groups map[string]string
+		err    error
+	)
+	//A broken groups file only gets in the way of requests that use groups
+	if req.Group != "" || req.Match == datums.MatchCompound {
+		groups, err = loadGroups(groupsPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	//An empty pattern targets every minion whatever the match type, so only the other filters narrow it down
+	all := strings.TrimSpace(req.Pattern) == ""
+	filtered := req.Group != "" || len(req.Labels) > 0 || len(req.Facts) > 0
+	switch {
+	case req.All && (!all || filtered):
+		return nil, nil, errors.New("--all can't be combined with --hosts, --labels, --facts or --group")
+	case all && !filtered && !req.All:
+		return nil, nil, errors.New("no minions targeted, pass --hosts, --labels, --facts or --group, or --all to target every minion")
+	}
+	switch req.Match {
+	case "", datums.MatchRegex:
+		hosts, err = target.Regex(req.Pattern)
+	case datums.MatchGlob:
+		hosts, err = target.Glob(req.Pattern)
+	case datums.MatchList:
+		for _, name := range strings.Split(req.Pattern, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		hosts = target.List(names...)
+	case datums.MatchCompound:
+		if !all {
+			hosts, err = target.Parse(req.Pattern, groupLookup(groups))
+		}
+	default:
+		err = fmt.Errorf("unknown match type %q, expected %s, %s, %s or %s", req.Match, datums.MatchRegex, datums.MatchGlob, datums.MatchList, datums.MatchCompound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var exprs []target.Expr
+	if !all {
+		exprs = append(exprs, hosts)
+	}
+	if req.Group != "" {
+		group, err := target.Parse("N@"+req.Group, groupLookup(groups))
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs = append(exprs, group)
+	}
+	for _, key := range datums.SortedKeys(req.Labels) {
+		label, err := target.Label(key, req.Labels[key])
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs = append(exprs, label)
+	}
+	for _, key := range datums.SortedKeys(req.Facts) {
+		fact, err := target.Fact(key, req.Facts[key])
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs = append(exprs, fact)
+	}
+	return target.And(exprs...), names, nil
+}
+
+func anyMatch(expr target.Expr, clients []*Client) bool {
+	for _, client := range clients {
+		if expr.Match(client.targetMinion()) {
+			return true
+		}
+	}
+	return false
+}
+
+//What target expressions see of a client
+func (client *Client) targetMinion() *target.Minion {
+	client.RLock()
+	defer client.RUnlock()
+	minion := &target.Minion{
+		ID:     client.ID,
+		Name:   client.Name,
+		Labels: client.Labels,
+		Facts:  client.Facts,
+	}
+	if addr, ok := client.IP.(*net.TCPAddr); ok {
+		minion.IP = addr.IP
+	}
+	return minion
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/charles-d-burton/hansel/target"
+)
+
+var targetMinions = []*target.Minion{
+	{ID: "web-1", Name: "web1", Labels: map[string]string{"role": "web"}},
+	{ID: "web-2", Name: "web2", Labels: map[string]string{"role": "web"}},
+	{ID: "db-1", Name: "db1", Labels: map[string]string{"role": "db"}},
+}
+
+func withGroupsFile(t *testing.T, content string) func() {
+	dir, err := ioutil.TempDir("", "hansel-groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "groups.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := groupsPath
+	groupsPath = file
+	return func() {
+		groupsPath = old
+		os.RemoveAll(dir)
+	}
+}
+
+func targeted(t *testing.T, req *datums.ControllerReq) []string {
+	expr, _, err := targetExpr(req)
+	if err != nil {
+		t.Fatalf("%+v: %v", req, err)
+	}
+	var ids []string
+	for _, minion := range targetMinions {
+		if expr.Match(minion) {
+			ids = append(ids, minion.ID)
+		}
+	}
+	return ids
+}
+
+func TestEmptyPatternNeedsAll(t *testing.T) {
+	defer withGroupsFile(t, "groups:\n  webfleet: I@role=web\n")()
+	every := []string{"web-1", "web-2", "db-1"}
+	for _, match := range []string{"", datums.MatchRegex, datums.MatchGlob, datums.MatchList, datums.MatchCompound} {
+		if _, _, err := targetExpr(&datums.ControllerReq{Match: match}); err == nil {
+			t.Errorf("match %q targeted every minion without --all", match)
+		}
+		if got := targeted(t, &datums.ControllerReq{Match: match, All: true}); !reflect.DeepEqual(got, every) {
+			t.Errorf("match %q with --all targeted %v", match, got)
+		}
+		got := targeted(t, &datums.ControllerReq{Match: match, Labels: map[string]string{"role": "db"}})
+		if !reflect.DeepEqual(got, []string{"db-1"}) {
+			t.Errorf("match %q with a label targeted %v", match, got)
+		}
+		got = targeted(t, &datums.ControllerReq{Match: match, Group: "webfleet"})
+		if !reflect.DeepEqual(got, []string{"web-1", "web-2"}) {
+			t.Errorf("match %q with a group targeted %v", match, got)
+		}
+	}
+	for _, req := range []*datums.ControllerReq{
+		{Pattern: "web-1", All: true},
+		{Labels: map[string]string{"role": "db"}, All: true},
+		{Group: "webfleet", All: true},
+	} {
+		if _, _, err := targetExpr(req); err == nil {
+			t.Errorf("%+v: --all was combined with another target", req)
+		}
+	}
+}
+
+func TestTargetExprMatchTypes(t *testing.T) {
+	defer withGroupsFile(t, "groups:\n  webfleet: I@role=web\n")()
+	tests := []struct {
+		req  datums.ControllerReq
+		want []string
+	}{
+		{datums.ControllerReq{Pattern: "^web"}, []string{"web-1", "web-2"}},
+		{datums.ControllerReq{Pattern: "*-1", Match: datums.MatchGlob}, []string{"web-1", "db-1"}},
+		{datums.ControllerReq{Pattern: "web-2, db1", Match: datums.MatchList}, []string{"web-2", "db-1"}},
+		{datums.ControllerReq{Pattern: "(N@webfleet and not web-1) or db-*", Match: datums.MatchCompound}, []string{"web-2", "db-1"}},
+	}
+	for _, test := range tests {
+		if got := targeted(t, &test.req); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v targeted %v, want %v", test.req, got, test.want)
+		}
+	}
+	if _, _, err := targetExpr(&datums.ControllerReq{Match: "fuzzy"}); err == nil {
+		t.Error("unknown match type was accepted")
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/charles-d-burton/hansel/keys"
+	"github.com/spf13/cobra"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+//How long a token presented during keyboard-interactive auth waits for the publickey step
+const grantTimeout = time.Minute
+
+var (
+	tokenTTL    time.Duration
+	tokenUses   int
+	tokenLabels map[string]string
+)
+
+//bootstrapToken is how a token is kept on disk, only a hash of the secret is stored
+type bootstrapToken struct {
+	ID      string            `json:"id"`
+	Hash    string            `json:"hash"`
+	Expires time.Time         `json:"expires"`
+	Uses    int               `json:"uses"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type tokenGrant struct {
+	id      string
+	hash    string
+	labels  map[string]string
+	created time.Time
+}
+
+//Tokens accepted during keyboard-interactive auth keyed by session, waiting for the client to prove its key
+var tokenGrants = struct {
+	sync.Mutex
+	grants map[string]tokenGrant
+}{grants: make(map[string]tokenGrant)}
+
+// tokensCmd represents the tokens command
+var tokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Manage bootstrap tokens",
+	Long: `Bootstrap tokens let new minions skip pending.  A minion started with
+--token has its key authorized and the token's labels applied when it connects.`,
+}
+
+var tokensCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a bootstrap token",
+	Run: func(cmd *cobra.Command, args []string) {
+		runTokenAction(&datums.TokenReq{
+			Action: datums.TokenActionCreate,
+			TTL:    tokenTTL,
+			Uses:   tokenUses,
+			Labels: tokenLabels,
+		})
+	},
+}
+
+var tokensListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List bootstrap tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		runTokenAction(&datums.TokenReq{Action: datums.TokenActionList})
+	},
+}
+
+var tokensDeleteCmd = &cobra.Command{
+	Use:   "delete <id>",
+	Short: "Delete a bootstrap token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runTokenAction(&datums.TokenReq{Action: datums.TokenActionDelete, ID: args[0]})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tokensCmd)
+	tokensCmd.AddCommand(tokensCreateCmd, tokensListCmd, tokensDeleteCmd)
+	tokensCreateCmd.Flags().DurationVar(&tokenTTL, "ttl", time.Hour, "How long the token is valid")
+	tokensCreateCmd.Flags().IntVar(&tokenUses, "uses", 1, "How many minions can use the token, 0 is unlimited")
+	tokensCreateCmd.Flags().StringToStringVar(&tokenLabels, "labels", nil, "Labels applied to minions using the token, e.g. role=web,env=prod")
+}
+
+func runTokenAction(req *datums.TokenReq) {
+	c, err := net.Dial("unix", domainSocketAddr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer c.Close()
+	enc := controlCodec().NewEncoder(c)
+	if err := enc.Encode(&datums.SocketReq{Tokens: req}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var result datums.TokenResult
+	dec := controlCodec().NewDecoder(c)
+	if err := dec.Decode(&result); err != nil {
+		fmt.Println("no response from server:", err)
+		os.Exit(1)
+	}
+	if result.Error != "" {
+		fmt.Println(result.Error)
+		os.Exit(1)
+	}
+	if result.Secret != "" {
+		fmt.Println(result.Secret)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEXPIRES\tUSES\tLABELS")
+	for _, token := range result.Tokens {
+		uses := "unlimited"
+		if token.Uses > 0 {
+			uses = fmt.Sprint(token.Uses)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", token.ID, token.Expires.Format(time.RFC3339), uses, datums.FormatLabels(token.Labels))
+	}
+	w.Flush()
+}
+
+//Handle a token request coming from the domain socket
+func handleTokenReq(req *datums.TokenReq) datums.TokenResult {
+	var result datums.TokenResult
+	var err error
+	switch req.Action {
+	case datums.TokenActionCreate:
+		result.Secret, err = createToken(req)
+	case datums.TokenActionList:
+		result.Tokens, err = listTokens()
+	case datums.TokenActionDelete:
+		err = deleteToken(req.ID)
+	default:
+		err = fmt.Errorf("unknown token action %q", req.Action)
+	}
+	if err != nil {
+		log.Println(err)
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func createToken(req *datums.TokenReq) (string, error) {
+	if req.TTL <= 0 {
+		return "", errors.New("ttl must be positive")
+	}
+	if req.Uses < 0 {
+		return "", errors.New("uses can't be negative")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+	hash := hashToken(token)
+	CFLocker.BootstrapTokens.Lock()
+	defer CFLocker.BootstrapTokens.Unlock()
+	tokens, err := readTokens()
+	if err != nil {
+		return "", err
+	}
+	tokens = append(tokens, bootstrapToken{
+		ID:      hash[:12],
+		Hash:    hash,
+		Expires: time.Now().Add(req.TTL),
+		Uses:    req.Uses,
+		Labels:  req.Labels,
+	})
+	if err := writeTokens(tokens); err != nil {
+		return "", err
+	}
+	log.Println("Created bootstrap token ", hash[:12])
+	return token, nil
+}
+
+func listTokens() ([]datums.TokenEntry, error) {
+	CFLocker.BootstrapTokens.RLock()
+	defer CFLocker.BootstrapTokens.RUnlock()
+	tokens, err := readTokens()
+	if err != nil {
+		return nil, err
+	}
+	var entries []datums.TokenEntry
+	for _, token := range tokens {
+		entries = append(entries, datums.TokenEntry{
+			ID:      token.ID,
+			Expires: token.Expires,
+			Uses:    token.Uses,
+			Labels:  token.Labels,
+		})
+	}
+	return entries, nil
+}
+
+func deleteToken(id string) error {
+	CFLocker.BootstrapTokens.Lock()
+	defer CFLocker.BootstrapTokens.Unlock()
+	tokens, err := readTokens()
+	if err != nil {
+		return err
+	}
+	var kept []bootstrapToken
+	for _, token := range tokens {
+		if token.ID != id {
+			kept = append(kept, token)
+		}
+	}
+	if len(kept) == len(tokens) {
+		return fmt.Errorf("no token %q", id)
+	}
+	return writeTokens(kept)
+}
+
+//Look up a live token by its secret without using it
+func findToken(secret string) (*bootstrapToken, error) {
+	return findTokenHash(hashToken(secret))
+}
+
+//Look up a live token by the hash of its secret without using it
+func findTokenHash(hash string) (*bootstrapToken, error) {
+	CFLocker.BootstrapTokens.RLock()
+	defer CFLocker.BootstrapTokens.RUnlock()
+	tokens, err := readTokens()
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) == 1 {
+			return &token, nil
+		}
+	}
+	return nil, errors.New("unknown or expired token")
+}
+
+//Use a token up once by the hash of its secret, it may have run out since it was found
+func consumeToken(hash string) (*bootstrapToken, error) {
+	CFLocker.BootstrapTokens.Lock()
+	defer CFLocker.BootstrapTokens.Unlock()
+	tokens, err := readTokens()
+	if err != nil {
+		return nil, err
+	}
+	for i, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if token.Uses == 1 {
+			tokens = append(tokens[:i], tokens[i+1:]...)
+		} else if token.Uses > 1 {
+			tokens[i].Uses--
+		}
+		if err := writeTokens(tokens); err != nil {
+			return nil, err
+		}
+		return &token, nil
+	}
+	return nil, errors.New("unknown or expired token")
+}
+
+//Read the live tokens, expired tokens are dropped the next time the store is written
+func readTokens() ([]bootstrapToken, error) {
+	buffer, err := ioutil.ReadFile(CFLocker.BootstrapTokens.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(buffer) == 0 {
+		return nil, nil
+	}
+	var tokens []bootstrapToken
+	if err := json.Unmarshal(buffer, &tokens); err != nil {
+		return nil, err
+	}
+	var live []bootstrapToken
+	now := time.Now()
+	for _, token := range tokens {
+		if now.Before(token.Expires) {
+			live = append(live, token)
+		}
+	}
+	return live, nil
+}
+
+func writeTokens(tokens []bootstrapToken) error {
+	buffer, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return keys.WriteFileAtomic(CFLocker.BootstrapTokens.ConfigFile, buffer)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//Ask the client for a bootstrap token during keyboard-interactive auth.  This always fails so the
+//client goes on to publickey auth, a valid token is remembered for the session until then.  The
+//token is only used up if the key turns out not to be authorized already.
+func validateToken(connMeta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	answers, err := challenge("", "", []string{"token: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 || answers[0] == "" {
+		return nil, errors.New("No token provided")
+	}
+	token, err := findToken(answers[0])
+	if err != nil {
+		log.Println("Refusing token from ", connMeta.User(), err)
+		return nil, errors.New("Token is not valid")
+	}
+	tokenGrants.Lock()
+	defer tokenGrants.Unlock()
+	for session, grant := range tokenGrants.grants {
+		if time.Since(grant.created) > grantTimeout {
+			delete(tokenGrants.grants, session)
+		}
+	}
+	tokenGrants.grants[string(connMeta.SessionID())] = tokenGrant{
+		id:      token.ID,
+		hash:    token.Hash,
+		labels:  token.Labels,
+		created: time.Now(),
+	}
+	log.Printf("Accepted token %s from %s, waiting for key", token.ID, connMeta.User())
+	return nil, errors.New("Token accepted, continue with publickey")
+}
+
+//Admit a key if the same session presented a valid token.  This runs for unsigned queries too, so the
+//token is only checked here, it is used up by redeemToken once the handshake proves the key is held.
+func redeemTokenGrant(connMeta ssh.ConnMetadata, key ssh.PublicKey) *ssh.Permissions {
+	tokenGrants.Lock()
+	grant, ok := tokenGrants.grants[string(connMeta.SessionID())]
+	tokenGrants.Unlock()
+	if !ok {
+		return nil
+	}
+	if _, err := findTokenHash(grant.hash); err != nil {
+		log.Printf("Token %s from %s can't be used: %v", grant.id, connMeta.User(), err)
+		return nil
+	}
+	return keyPermissions(key, map[string]string{
+		"admitted":    "token",
+		"admitted_by": "token " + grant.id,
+		"token":       grant.hash,
+		"labels":      datums.FormatLabels(grant.labels),
+	})
+}
+
+//Use up the token a connection was admitted with, the connection has to be dropped if this fails
+func redeemToken(conn *ssh.ServerConn) error {
+	tokenGrants.Lock()
+	delete(tokenGrants.grants, string(conn.SessionID()))
+	tokenGrants.Unlock()
+	token, err := consumeToken(conn.Permissions.Extensions["token"])
+	if err != nil {
+		return fmt.Errorf("token for %s can't be used: %v", conn.User(), err)
+	}
+	log.Printf("Admitting %s with token %s", conn.User(), token.ID)
+	return nil
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+func withTokenStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "hansel-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := CFLocker
+	CFLocker = &ConfigFileLocker{}
+	CFLocker.BootstrapTokens.ConfigFile = file
+	return func() {
+		CFLocker = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFindTokenDoesNotSpendUses(t *testing.T) {
+	defer withTokenStore(t)()
+	secret, err := createToken(&datums.TokenReq{TTL: time.Hour, Uses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := findToken(secret); err != nil {
+			t.Fatalf("find %d: %v", i, err)
+		}
+	}
+	entries, err := listTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Uses != 2 {
+		t.Fatalf("finding a token spent uses: %+v", entries)
+	}
+}
+
+func TestConsumeTokenCountsDown(t *testing.T) {
+	defer withTokenStore(t)()
+	secret, err := createToken(&datums.TokenReq{TTL: time.Hour, Uses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := findToken(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := consumeToken(token.Hash); err != nil {
+			t.Fatalf("use %d: %v", i, err)
+		}
+	}
+	if _, err := consumeToken(token.Hash); err == nil {
+		t.Fatal("token was used more times than it allows")
+	}
+	if _, err := findToken(secret); err == nil {
+		t.Fatal("used up token is still found")
+	}
+}
+
+func TestUnlimitedTokenIsKept(t *testing.T) {
+	defer withTokenStore(t)()
+	secret, err := createToken(&datums.TokenReq{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := findToken(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := consumeToken(token.Hash); err != nil {
+			t.Fatalf("use %d: %v", i, err)
+		}
+	}
+}
+
+func TestExpiredTokenIsRefused(t *testing.T) {
+	defer withTokenStore(t)()
+	secret, err := createToken(&datums.TokenReq{TTL: time.Nanosecond, Uses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := findToken(secret); err == nil {
+		t.Fatal("expired token was found")
+	}
+}
+
+//A query reaches the auth callback without proving the key is held, only the handshake may spend a use
+func TestTokenIsOnlyUsedAfterHandshake(t *testing.T) {
+	defer withTokenStore(t)()
+	secret, err := createToken(&datums.TokenReq{TTL: time.Hour, Uses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := findToken(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := fakeConnMeta{user: "minion-1", session: "session-1"}
+	tokenGrants.Lock()
+	tokenGrants.grants[meta.session] = tokenGrant{id: token.ID, hash: token.Hash, created: time.Now()}
+	tokenGrants.Unlock()
+
+	key := testPublicKey(t)
+	var perms *ssh.Permissions
+	for i := 0; i < 3; i++ {
+		if perms = redeemTokenGrant(meta, key); perms == nil {
+			t.Fatalf("query %d was refused", i)
+		}
+	}
+	if perms.Extensions["admitted"] != "token" {
+		t.Fatalf("permissions %v", perms.Extensions)
+	}
+	if _, err := findToken(secret); err != nil {
+		t.Fatal("queries used the token up")
+	}
+	if err := redeemToken(serverConn(meta, perms)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findToken(secret); err == nil {
+		t.Fatal("single use token is still there")
+	}
+	//A second connection that got the same grant before the token ran out is dropped
+	if err := redeemToken(serverConn(meta, perms)); err == nil {
+		t.Fatal("used up token was redeemed again")
+	}
+}
@@ -0,0 +1,540 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/charles-d-burton/hansel/keys"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+//Every minion key and what is known about it
+var keyStore *keys.Store
+
+//Handle a key management request coming from the domain socket
+func handleKeyReq(req *datums.KeyReq) datums.KeyResult {
+	var result datums.KeyResult
+	if req.Action != datums.KeyActionList && !req.Master && !req.All && req.Pattern == "" {
+		result.Error = "a pattern or --all is required"
+		return result
+	}
+	var (
+		keys []datums.KeyEntry
+		err  error
+	)
+	switch req.Action {
+	case datums.KeyActionList:
+		keys, err = listUsers(req)
+	case datums.KeyActionAccept:
+		keys, err = acceptUsers(req)
+	case datums.KeyActionReject:
+		keys, err = rejectUsers(req)
+	case datums.KeyActionRevoke:
+		keys, err = revokeUsers(req)
+	case datums.KeyActionDelete:
+		keys, err = deleteUsers(req)
+	case datums.KeyActionRotate:
+		if req.Master {
+			keys, err = rotateMasterKey(req.Grace)
+		} else {
+			keys, err = rotateMinionKeys(req)
+		}
+	default:
+		err = fmt.Errorf("unknown key action %q", req.Action)
+	}
+	if err != nil {
+		log.Println(err)
+		result.Error = err.Error()
+	}
+	result.Keys = keys
+	return result
+}
+
+//List the keys that match the request
+func listUsers(req *datums.KeyReq) ([]datums.KeyEntry, error) {
+	var matched []datums.KeyEntry
+	for _, record := range keyStore.List() {
+		entry := keyEntry(&record)
+		if req.Pattern == "" || matchUser(req, entry) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+//Move matching users from pending or rejected to authorized
+func acceptUsers(req *datums.KeyReq) ([]datums.KeyEntry, error) {
+	return moveUsers(req, datums.KeyStateAuthorized, datums.KeyStatePending, datums.KeyStateRejected)
+}
+
+//Move matching users from pending to rejected, they are refused from then on without being re-queued
+func rejectUsers(req *datums.KeyReq) ([]datums.KeyEntry, error) {
+	return moveUsers(req, datums.KeyStateRejected, datums.KeyStatePending)
+}
+
+//Move matching users from every other state to revoked and kick any live sessions
+func revokeUsers(req *datums.KeyReq) ([]datums.KeyEntry, error) {
+	revoked, err := moveUsers(req, datums.KeyStateRevoked,
+		datums.KeyStateAuthorized, datums.KeyStatePending, datums.KeyStateRejected)
+	if err != nil {
+		return nil, err
+	}
+	//Minions admitted by certificate aren't in the store, they can still be revoked by fingerprint
+	if len(revoked) == 0 && strings.HasPrefix(req.Pattern, "SHA256:") {
+		revoked, err = revokeFingerprint(req.Pattern, req.By)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range revoked {
+		closed := registry.CloseFingerprint(entry.Fingerprint)
+		log.Printf("Revoked %s (%s), closed %d sessions", entry.ID, entry.Fingerprint, closed)
+	}
+	return revoked, nil
+}
+
+func revokeFingerprint(sha, by string) ([]datums.KeyEntry, error) {
+	var entry datums.KeyEntry
+	err := keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		//The minion isn't known so the record is kept under the fingerprint
+		record, ok := records[sha]
+		if !ok {
+			record = &keys.KeyRecord{Fingerprint: sha, FirstSeen: time.Now()}
+			records[sha] = record
+		}
+		record.AddEvent(datums.KeyStateRevoked, by, "")
+		entry = keyEntry(record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []datums.KeyEntry{entry}, nil
+}
+
+//Move matching users in any of the source states to the destination
+func moveUsers(req *datums.KeyReq, to string, from ...string) ([]datums.KeyEntry, error) {
+	var moved []datums.KeyEntry
+	err := keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		moved = nil
+		for _, record := range records {
+			if !containsState(from, record.State) || !matchUser(req, keyEntry(record)) {
+				continue
+			}
+			setKeyState(record, to, req.By, "")
+			moved = append(moved, keyEntry(record))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortEntries(moved)
+	return moved, nil
+}
+
+//Remove matching minions from the store, they queue up in pending again on their next connect
+func deleteUsers(req *datums.KeyReq) ([]datums.KeyEntry, error) {
+	var deleted []datums.KeyEntry
+	err := keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		deleted = nil
+		for key, record := range records {
+			if matchUser(req, keyEntry(record)) {
+				deleted = append(deleted, keyEntry(record))
+				delete(records, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortEntries(deleted)
+	return deleted, nil
+}
+
+//Authorize a minion's key straight away whatever state it was in, applying any labels
+func authorizeUser(conn *ssh.ServerConn, labels map[string]string, by string) error {
+	sha := conn.Permissions.Extensions["fingerprint"]
+	return keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		record, ok := records[conn.User()]
+		if !ok {
+			record = newKeyRecord(conn, sha, conn.Permissions.Extensions["public_key"])
+			records[conn.User()] = record
+		}
+		if record.Fingerprint != sha {
+			return fmt.Errorf("minion %s is registered with %s", record.ID, record.Fingerprint)
+		}
+		if len(labels) > 0 {
+			record.Labels = labels
+		}
+		setKeyState(record, datums.KeyStateAuthorized, by, "")
+		return nil
+	})
+}
+
+//Queue a minion the policy didn't decide on for an operator, a minion that is already known stays as
+//it is.  Only called once the handshake has proven the minion holds the key, so nobody can queue a key
+//they don't have under an ID they made up.
+func markUserPending(conn *ssh.ServerConn) error {
+	sha := conn.Permissions.Extensions["fingerprint"]
+	return keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		if _, ok := records[conn.User()]; ok {
+			return nil
+		}
+		//A key still kept under the minion's hostname is already queued there
+		for _, record := range records {
+			if record.Fingerprint == sha {
+				return nil
+			}
+		}
+		log.Println("User not found, marking pending")
+		record := newKeyRecord(conn, sha, conn.Permissions.Extensions["public_key"])
+		record.AddEvent(datums.KeyStatePending, "", "")
+		records[conn.User()] = record
+		return nil
+	})
+}
+
+//Make sure a key and the minion ID it is presented with belong together, so a cloned or renamed
+//host can't take over another minion.  Keys registered before minions had IDs are known by the
+//hostname, the hostname record is returned so it can be moved to the minion's ID once the handshake
+//proves the minion holds the key.  Nothing is written here, the auth callback only looks.
+func claimMinionID(connMeta ssh.ConnMetadata, sha string) (string, error) {
+	id := connMeta.User()
+	if record, ok := keyStore.GetByFingerprint(sha); ok && record.ID != id {
+		if record.ID == "" || record.ID != minionHostname(connMeta) {
+			return "", fmt.Errorf("key %s is registered to minion %s", sha, record.Key())
+		}
+		if _, ok := keyStore.Get(id); ok {
+			return "", fmt.Errorf("minion %s is already registered", id)
+		}
+		return record.Key(), nil
+	}
+	if record, ok := keyStore.Get(id); ok && record.Fingerprint != sha {
+		return "", fmt.Errorf("minion %s is registered with %s", id, record.Fingerprint)
+	}
+	return "", nil
+}
+
+//Move a record kept under the minion's hostname to its ID, run once the handshake has succeeded
+func adoptMinionID(id, sha, hostname string) error {
+	return keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		adopted, ok := records[hostname]
+		//Checked again, the store may have changed since the key was looked up
+		if !ok || adopted.Fingerprint != sha {
+			return fmt.Errorf("key %s is no longer registered to %s", sha, hostname)
+		}
+		if _, ok := records[id]; ok {
+			return fmt.Errorf("minion %s is already registered", id)
+		}
+		delete(records, hostname)
+		adopted.ID = id
+		adopted.AddEvent(adopted.State, "", "moved from "+hostname+" to the minion's ID")
+		records[id] = adopted
+		log.Printf("Moved %s to minion ID %s", hostname, id)
+		return nil
+	})
+}
+
+//Swap the key of an authorized minion in a single write so there is never a moment where neither
+//or both keys are authorized
+func replaceUserKey(id, sha string, key ssh.PublicKey) error {
+	return keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		record, ok := records[id]
+		if !ok || record.Fingerprint != sha || record.State != datums.KeyStateAuthorized {
+			return fmt.Errorf("%s is not authorized with %s", id, sha)
+		}
+		record.Fingerprint = ssh.FingerprintSHA256(key)
+		record.PublicKey = marshalPublicKey(key)
+		record.AddEvent(datums.KeyStateAuthorized, "rotation", "rotated from "+sha)
+		return nil
+	})
+}
+
+//Note when and where an authorized key last connected from
+func recordSeen(conn *ssh.ServerConn) error {
+	sha := conn.Permissions.Extensions["fingerprint"]
+	if record, ok := keyStore.Get(conn.User()); !ok || record.Fingerprint != sha {
+		return nil
+	}
+	return keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		record, ok := records[conn.User()]
+		if !ok || record.Fingerprint != sha {
+			return nil
+		}
+		record.LastSeen = time.Now()
+		record.SourceIP = remoteIP(conn)
+		record.Hostname = minionHostname(conn)
+		//Keys migrated from the old user files only had a fingerprint
+		if record.PublicKey == "" {
+			record.PublicKey = conn.Permissions.Extensions["public_key"]
+		}
+		return nil
+	})
+}
+
+//Note the build and protocol version a minion negotiated so mixed fleets can be tracked through an upgrade
+func recordHello(conn *ssh.ServerConn, hello *datums.Hello, ack *datums.HelloAck) error {
+	sha := conn.Permissions.Extensions["fingerprint"]
+	return keyStore.Update(func(records map[string]*keys.KeyRecord) error {
+		record, ok := records[conn.User()]
+		if !ok || record.Fingerprint != sha {
+			return nil
+		}
+		record.BuildVersion = hello.BuildVersion
+		record.Protocol = ack.Version
+		return nil
+	})
+}
+
+//Check if a minion is authorized to connect with the key, key is the minion ID or the hostname of a
+//record that hasn't moved to its ID yet
+func isUserValid(key, sha string) bool {
+	record, ok := keyStore.Get(key)
+	return ok && record.Fingerprint == sha && record.State == datums.KeyStateAuthorized
+}
+
+//Check if a key fingerprint has been revoked, the minion doesn't matter
+func isKeyRevoked(sha string) bool {
+	record, ok := keyStore.GetByFingerprint(sha)
+	return ok && record.State == datums.KeyStateRevoked
+}
+
+//Check if a minion and key have been rejected
+func isUserRejected(key, sha string) bool {
+	record, ok := keyStore.Get(key)
+	return ok && record.Fingerprint == sha && record.State == datums.KeyStateRejected
+}
+
+func newKeyRecord(connMeta ssh.ConnMetadata, sha, publicKey string) *keys.KeyRecord {
+	now := time.Now()
+	return &keys.KeyRecord{
+		ID:          connMeta.User(),
+		Fingerprint: sha,
+		PublicKey:   publicKey,
+		Hostname:    minionHostname(connMeta),
+		SourceIP:    remoteIP(connMeta),
+		FirstSeen:   now,
+		LastSeen:    now,
+	}
+}
+
+//Move a record to a state, authorizing it also records who accepted it
+func setKeyState(record *keys.KeyRecord, state, by, note string) {
+	record.AddEvent(state, by, note)
+	if state == datums.KeyStateAuthorized {
+		record.AcceptedBy = by
+		record.AcceptedAt = time.Now()
+	}
+}
+
+func keyEntry(record *keys.KeyRecord) datums.KeyEntry {
+	entry := datums.KeyEntry{
+		ID:           record.ID,
+		Fingerprint:  record.Fingerprint,
+		State:        record.State,
+		Labels:       record.Labels,
+		PublicKey:    record.PublicKey,
+		Hostname:     record.Hostname,
+		SourceIP:     record.SourceIP,
+		FirstSeen:    record.FirstSeen,
+		LastSeen:     record.LastSeen,
+		AcceptedBy:   record.AcceptedBy,
+		AcceptedAt:   record.AcceptedAt,
+		BuildVersion: record.BuildVersion,
+		Protocol:     record.Protocol,
+	}
+	for _, event := range record.History {
+		entry.History = append(entry.History, datums.KeyEvent{
+			Time:  event.Time,
+			State: event.State,
+			By:    event.By,
+			Note:  event.Note,
+		})
+	}
+	return entry
+}
+
+func marshalPublicKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func remoteIP(connMeta ssh.ConnMetadata) string {
+	host, _, err := net.SplitHostPort(connMeta.RemoteAddr().String())
+	if err != nil {
+		return connMeta.RemoteAddr().String()
+	}
+	return host
+}
+
+//Match an entry against the request pattern, either a glob on the minion ID or hostname or the exact fingerprint
+func matchUser(req *datums.KeyReq, entry datums.KeyEntry) bool {
+	if req.All {
+		return true
+	}
+	if req.Pattern == entry.Fingerprint {
+		return true
+	}
+	for _, name := range []string{entry.ID, entry.Hostname} {
+		matched, err := filepath.Match(req.Pattern, name)
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsState(states []string, state string) bool {
+	for _, existing := range states {
+		if existing == state {
+			return true
+		}
+	}
+	return false
+}
+
+func sortEntries(entries []datums.KeyEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ID != entries[j].ID {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Fingerprint < entries[j].Fingerprint
+	})
+}
+
+//legacyUserFile is one of the user=sha files the key store replaced, the user was the minion's hostname
+type legacyUserFile struct {
+	path  string
+	state string
+}
+
+//Load the key store, importing the user=sha files it replaces the first time.  The old files are
+//keyed by hostname, each minion's record moves to its ID when it first connects.
+func openKeyStore(path string, legacy []legacyUserFile) (*keys.Store, error) {
+	store, err := keys.OpenStore(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(store.List()) > 0 {
+		return store, nil
+	}
+	err = store.Update(func(records map[string]*keys.KeyRecord) error {
+		for _, file := range legacy {
+			entries, err := readLegacyUsers(file.path, file.state)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				importLegacyUser(records, entry, file.path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	//Move the old files out of the way so it's obvious they are no longer read
+	for _, file := range legacy {
+		if _, err := os.Stat(file.path); err != nil {
+			continue
+		}
+		log.Println("Imported ", file.path, " into ", path)
+		if err := os.Rename(file.path, file.path+".migrated"); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+//Import one user=sha line.  A name can only hold one key now, a revocation is kept either way.
+func importLegacyUser(records map[string]*keys.KeyRecord, entry datums.KeyEntry, file string) {
+	note := "imported from " + file
+	for _, existing := range records {
+		if existing.Fingerprint != entry.Fingerprint {
+			continue
+		}
+		if entry.State == datums.KeyStateRevoked {
+			setKeyState(existing, entry.State, "migration", note)
+			return
+		}
+		log.Printf("Skipping %s from %s, the key is already imported", entry.ID, file)
+		return
+	}
+	record := &keys.KeyRecord{
+		ID:          entry.ID,
+		Fingerprint: entry.Fingerprint,
+		Hostname:    entry.ID,
+		Labels:      entry.Labels,
+	}
+	if _, ok := records[entry.ID]; ok {
+		if entry.State != datums.KeyStateRevoked {
+			log.Printf("Skipping %s from %s, it already has a key", entry.ID, file)
+			return
+		}
+		record.ID = ""
+	}
+	setKeyState(record, entry.State, "migration", note)
+	records[record.Key()] = record
+}
+
+//Read all of the user=sha lines out of one of the old user files
+func readLegacyUsers(path, state string) ([]datums.KeyEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []datums.KeyEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		userAndKey := strings.SplitN(scanner.Text(), "=", 2)
+		if len(userAndKey) != 2 {
+			continue
+		}
+		//The fingerprint can be followed by the minion's labels
+		fields := strings.Fields(userAndKey[1])
+		if len(fields) == 0 {
+			continue
+		}
+		entry := datums.KeyEntry{
+			ID:          strings.TrimSpace(userAndKey[0]),
+			Fingerprint: fields[0],
+			State:       state,
+		}
+		if len(fields) > 1 {
+			entry.Labels = datums.ParseLabels(fields[1])
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/charles-d-burton/hansel/keys"
+	"golang.org/x/crypto/ed25519"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+func TestOpenKeyStoreImportsLegacyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"authorized_users": "web-1=SHA256:web1 role=web,env=prod\nweb-2=SHA256:web2\nbroken line\n",
+		"pending_users":    "db-1=SHA256:db1\nweb-1=SHA256:other\n",
+		"revoked_users":    "web-2=SHA256:web2\nold=SHA256:old\nweb-1=SHA256:stolen\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy := []legacyUserFile{
+		{filepath.Join(dir, "authorized_users"), datums.KeyStateAuthorized},
+		{filepath.Join(dir, "rejected_users"), datums.KeyStateRejected},
+		{filepath.Join(dir, "pending_users"), datums.KeyStatePending},
+		{filepath.Join(dir, "revoked_users"), datums.KeyStateRevoked},
+	}
+	path := filepath.Join(dir, "keys.json")
+	store, err := openKeyStore(path, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web1, ok := store.Get("web-1")
+	if !ok || web1.State != datums.KeyStateAuthorized || web1.Fingerprint != "SHA256:web1" || web1.Labels["env"] != "prod" {
+		t.Errorf("web-1: %+v", web1)
+	}
+	if web1.Hostname != "web-1" {
+		t.Errorf("web-1 hostname %q", web1.Hostname)
+	}
+	//A revocation of a key already imported wins
+	if web2, _ := store.Get("web-2"); web2.State != datums.KeyStateRevoked {
+		t.Errorf("web-2 is %s", web2.State)
+	}
+	if db1, _ := store.Get("db-1"); db1.State != datums.KeyStatePending {
+		t.Errorf("db-1 is %s", db1.State)
+	}
+	//A second key for a name is dropped unless it is revoked, then it is kept by fingerprint
+	if _, ok := store.GetByFingerprint("SHA256:other"); ok {
+		t.Error("second pending key for web-1 was imported")
+	}
+	if stolen, ok := store.GetByFingerprint("SHA256:stolen"); !ok || stolen.State != datums.KeyStateRevoked || stolen.ID != "" {
+		t.Errorf("revoked second key for web-1: %+v", stolen)
+	}
+	if old, _ := store.Get("old"); old.State != datums.KeyStateRevoked {
+		t.Errorf("old is %s", old.State)
+	}
+
+	for name := range files {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't moved out of the way", name)
+		}
+		if _, err := os.Stat(file + ".migrated"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	//Opening again reads the store and leaves new legacy files alone
+	if err := ioutil.WriteFile(legacy[0].path, []byte("new=SHA256:new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err = openKeyStore(path, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("new"); ok {
+		t.Error("legacy file imported into a store that already has keys")
+	}
+	if len(store.List()) != 5 {
+		t.Errorf("reopened store has %d records", len(store.List()))
+	}
+}
+
+func withKeyStore(t *testing.T, records ...*keys.KeyRecord) func() {
+	dir, err := ioutil.TempDir("", "hansel-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := keys.OpenStore(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(existing map[string]*keys.KeyRecord) error {
+		for _, record := range records {
+			existing[record.Key()] = record
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := keyStore
+	keyStore = store
+	return func() {
+		keyStore = old
+		os.RemoveAll(dir)
+	}
+}
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+//Queries reach the auth callback before any signature is checked, so it must not move records
+func TestLegacyRecordMovesOnlyAfterHandshake(t *testing.T) {
+	key := testPublicKey(t)
+	sha := ssh.FingerprintSHA256(key)
+	defer withKeyStore(t, &keys.KeyRecord{ID: "web1", Fingerprint: sha, State: datums.KeyStateAuthorized})()
+
+	meta := fakeConnMeta{user: "chosen-id", version: clientVersionPrefix + "web1", addr: "10.0.0.1:22"}
+	perms, err := validatePubKey(meta, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.Extensions["adopt"] != "web1" {
+		t.Fatalf("permissions %v", perms.Extensions)
+	}
+	if _, ok := keyStore.Get("web1"); !ok {
+		t.Fatal("the auth callback moved the record")
+	}
+	if _, ok := keyStore.Get("chosen-id"); ok {
+		t.Fatal("the auth callback created a record")
+	}
+
+	if err := adoptMinionID("minion-1", sha, "web1"); err != nil {
+		t.Fatal(err)
+	}
+	record, ok := keyStore.Get("minion-1")
+	if !ok || record.Fingerprint != sha || record.State != datums.KeyStateAuthorized {
+		t.Fatalf("adopted record %+v", record)
+	}
+	if _, ok := keyStore.Get("web1"); ok {
+		t.Fatal("hostname record is still there")
+	}
+	//Once moved, the key only belongs to the minion that proved it holds it
+	if _, err := validatePubKey(meta, key); err == nil {
+		t.Fatal("another ID was admitted with the adopted key")
+	}
+	if err := adoptMinionID("minion-2", sha, "web1"); err == nil {
+		t.Fatal("record was adopted twice")
+	}
+}
+
+func TestClaimMinionIDRefusesOtherMinionsKeys(t *testing.T) {
+	key := testPublicKey(t)
+	sha := ssh.FingerprintSHA256(key)
+	defer withKeyStore(t,
+		&keys.KeyRecord{ID: "minion-1", Fingerprint: sha, State: datums.KeyStateAuthorized},
+		&keys.KeyRecord{ID: "minion-2", Fingerprint: "SHA256:other", State: datums.KeyStateAuthorized},
+	)()
+	tests := []fakeConnMeta{
+		{user: "minion-3", version: clientVersionPrefix + "host"},
+		{user: "minion-3", version: "SSH-2.0-OpenSSH_9.0"},
+		{user: "minion-2", version: clientVersionPrefix + "host"},
+	}
+	for _, meta := range tests {
+		if _, err := claimMinionID(meta, sha); err == nil {
+			t.Errorf("%s as %s was allowed", meta.user, meta.version)
+		}
+	}
+	if legacy, err := claimMinionID(fakeConnMeta{user: "minion-1"}, sha); err != nil || legacy != "" {
+		t.Errorf("owner got %q, %v", legacy, err)
+	}
+}
+
+//Anyone can query keys without holding them, so the pending record waits for the handshake
+func TestPendingRecordOnlyAfterHandshake(t *testing.T) {
+	key := testPublicKey(t)
+	defer withKeyStore(t)()
+	old := policyPath
+	policyPath = filepath.Join(os.TempDir(), "hansel-no-such-policy.yaml")
+	defer func() { policyPath = old }()
+
+	meta := fakeConnMeta{user: "minion-1", version: clientVersionPrefix + "web1", addr: "10.0.0.1:22"}
+	perms, err := validatePubKey(meta, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.Extensions["admitted"] != "pending" {
+		t.Fatalf("permissions %v", perms.Extensions)
+	}
+	if len(keyStore.List()) != 0 {
+		t.Fatal("the auth callback created a record")
+	}
+
+	if err := markUserPending(serverConn(meta, perms)); err != nil {
+		t.Fatal(err)
+	}
+	record, ok := keyStore.Get("minion-1")
+	if !ok || record.State != datums.KeyStatePending || record.Fingerprint != ssh.FingerprintSHA256(key) {
+		t.Fatalf("pending record %+v", record)
+	}
+}
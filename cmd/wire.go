@@ -0,0 +1,208 @@
+// Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/spf13/viper"
+)
+
+//A channel carrying envelopes.  Every channel starts out in gob for the hello and switches once to
+//the negotiated codec, reads go through one buffered reader so nothing is lost in the switch.
+type wireStream struct {
+	//Writes come from the job and the output it streams
+	writeLock sync.Mutex
+	version   int
+	codec     datums.Codec
+	//Payloads over the threshold are compressed with this
+	compression string
+	writer      io.Writer
+	reader      *bufio.Reader
+	enc         datums.Encoder
+	dec         datums.Decoder
+}
+
+func newWireStream(rw io.ReadWriter) *wireStream {
+	stream := &wireStream{
+		version: datums.ProtocolVersion,
+		writer:  rw,
+		reader:  bufio.NewReader(rw),
+	}
+	stream.setCodec(datums.Gob)
+	return stream
+}
+
+func (stream *wireStream) setCodec(codec datums.Codec) {
+	if dumpFrames() {
+		codec = dumpCodec{codec}
+	}
+	stream.codec = codec
+	stream.enc = codec.NewEncoder(stream.writer)
+	stream.dec = codec.NewDecoder(stream.reader)
+}
+
+//Switch to the codec agreed on in the hello
+func (stream *wireStream) switchCodec(name string) error {
+	if name == stream.codec.Name() {
+		return nil
+	}
+	codec, err := datums.GetCodec(name)
+	if err != nil {
+		return err
+	}
+	stream.setCodec(codec)
+	return nil
+}
+
+//Speak what was agreed on in the hello, job channels skip straight to it
+func (stream *wireStream) agree(ack *datums.HelloAck) error {
+	stream.version = ack.Version
+	stream.compression = ack.Compression
+	return stream.switchCodec(ack.Codec)
+}
+
+//Wrap a payload in an envelope and write it to the stream
+func (stream *wireStream) write(payload interface{}, correlationID string) error {
+	env, err := datums.NewEnvelope(stream.codec, payload, correlationID)
+	if err != nil {
+		return err
+	}
+	//Older peers refuse envelopes newer than what they agreed to
+	env.Version = stream.version
+	err = env.Compress(stream.compression, viper.GetInt("compress-threshold"))
+	if err != nil {
+		return err
+	}
+	stream.writeLock.Lock()
+	defer stream.writeLock.Unlock()
+	return stream.enc.Encode(env)
+}
+
+func (stream *wireStream) read() (*datums.Envelope, error) {
+	var env datums.Envelope
+	err := stream.dec.Decode(&env)
+	if err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+//Decode the payload of an envelope read from the stream
+func (stream *wireStream) open(env *datums.Envelope) (interface{}, error) {
+	return env.Open(stream.codec)
+}
+
+//The codecs this side will speak, --codec narrows them down to one
+func wireCodecs() ([]string, error) {
+	name := viper.GetString("codec")
+	if name == "" {
+		return datums.SupportedCodecs, nil
+	}
+	if _, err := datums.GetCodec(name); err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
+//The compression this side will use, --compression narrows it down to one
+func wireCompression() ([]string, error) {
+	name := viper.GetString("compression")
+	if name == "" {
+		return datums.SupportedCompression, nil
+	}
+	if _, err := datums.GetCompressor(name); err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
+//The control socket never leaves the master so its codec isn't negotiated
+func controlCodec() datums.Codec {
+	if dumpFrames() {
+		return dumpCodec{datums.Gob}
+	}
+	return datums.Gob
+}
+
+//Frames are logged in readable form whenever a codec is picked by hand
+func dumpFrames() bool {
+	return viper.GetString("codec") != ""
+}
+
+//Logs every frame that goes through the codec it wraps
+type dumpCodec struct {
+	datums.Codec
+}
+
+func (codec dumpCodec) NewEncoder(w io.Writer) datums.Encoder {
+	return dumpEncoder{codec.Codec, codec.Codec.NewEncoder(w)}
+}
+
+func (codec dumpCodec) NewDecoder(r io.Reader) datums.Decoder {
+	return dumpDecoder{codec.Codec, codec.Codec.NewDecoder(r)}
+}
+
+type dumpEncoder struct {
+	codec datums.Codec
+	datums.Encoder
+}
+
+func (enc dumpEncoder) Encode(v interface{}) error {
+	dumpFrame("sent", enc.codec, v)
+	return enc.Encoder.Encode(v)
+}
+
+type dumpDecoder struct {
+	codec datums.Codec
+	datums.Decoder
+}
+
+func (dec dumpDecoder) Decode(v interface{}) error {
+	err := dec.Decoder.Decode(v)
+	if err == nil {
+		dumpFrame("received", dec.codec, v)
+	}
+	return err
+}
+
+//Envelopes are shown with their payload decoded
+func dumpFrame(direction string, codec datums.Codec, v interface{}) {
+	frame := v
+	if env, ok := v.(*datums.Envelope); ok {
+		var shown interface{}
+		payload, err := env.Open(codec)
+		if err != nil {
+			shown = err.Error()
+		} else {
+			shown = payload
+		}
+		frame = struct {
+			*datums.Envelope
+			Payload interface{}
+		}{env, shown}
+	}
+	out, err := json.MarshalIndent(frame, "", "  ")
+	if err != nil {
+		log.Printf("%s %s frame: %+v", direction, codec.Name(), v)
+		return
+	}
+	log.Printf("%s %s frame:\n%s", direction, codec.Name(), out)
+}
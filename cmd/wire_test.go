@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/charles-d-burton/hansel/datums"
+	"github.com/spf13/viper"
+)
+
+//The hello goes out in gob and everything after it in the agreed codec, on one buffered stream
+func TestWireStreamSwitchesCodecAfterHello(t *testing.T) {
+	viper.Set("compress-threshold", 1024)
+	defer viper.Set("compress-threshold", nil)
+	for _, codec := range datums.SupportedCodecs {
+		for _, compression := range datums.SupportedCompression {
+			var buf bytes.Buffer
+			sender, receiver := newWireStream(&buf), newWireStream(&buf)
+			ack := &datums.HelloAck{Version: datums.ProtocolVersion, Codec: codec, Compression: compression}
+			if err := sender.write(ack, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := sender.agree(ack); err != nil {
+				t.Fatal(err)
+			}
+			small := &datums.OutputChunk{JID: "j1", Data: "small"}
+			large := &datums.OutputChunk{JID: "j1", Seq: 1, Data: strings.Repeat("large ", 1000)}
+			for _, chunk := range []*datums.OutputChunk{small, large} {
+				if err := sender.write(chunk, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			env, err := receiver.read()
+			if err != nil {
+				t.Fatalf("%s/%s: hello: %v", codec, compression, err)
+			}
+			payload, err := receiver.open(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := receiver.agree(payload.(*datums.HelloAck)); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []*datums.OutputChunk{small, large} {
+				env, err := receiver.read()
+				if err != nil {
+					t.Fatalf("%s/%s: %v", codec, compression, err)
+				}
+				//Only payloads over the threshold are compressed
+				compressed := compression != datums.CompressionNone && want == large
+				if (env.Compression != "") != compressed {
+					t.Errorf("%s/%s: seq %d compressed with %q", codec, compression, want.Seq, env.Compression)
+				}
+				payload, err := receiver.open(env)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := payload.(*datums.OutputChunk); got.Data != want.Data || got.Seq != want.Seq {
+					t.Errorf("%s/%s: got seq %d", codec, compression, got.Seq)
+				}
+			}
+		}
+	}
+}
+
+func TestWireStreamWritesTheAgreedVersion(t *testing.T) {
+	var buf bytes.Buffer
+	sender, receiver := newWireStream(&buf), newWireStream(&buf)
+	ack := &datums.HelloAck{Version: 1, Codec: datums.CodecGob, Compression: datums.CompressionNone}
+	if err := sender.agree(ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.agree(ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.write(&datums.ClientStatus{Message: "keepalive"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	env, err := receiver.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Version != 1 {
+		t.Fatalf("wrote version %d to a version 1 peer", env.Version)
+	}
+}
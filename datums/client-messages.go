@@ -1,30 +1,72 @@
 package datums
 
+//ClientResult answers a job, JID is the job the master dispatched
 type ClientResult struct {
+	ID         string
 	Name       string
-	Results    []string
+	JID        string
+	Actions    []ActionResult
 	Controller ControllerResult
 }
 
-func (result *ClientResult) GetResult() []string {
-	return result.Results
+//Streams output is tagged with
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+//OutputChunk is a line, or part of a long one, of output from an action while a job runs.  Seq counts
+//up from 1 across the whole job so the chunks can be put back in order.
+type OutputChunk struct {
+	ID     string
+	Name   string
+	JID    string
+	Index  int
+	Stream string
+	Seq    int
+	Data   string
+}
+
+func (chunk *OutputChunk) GetResults() []string {
+	return []string{chunk.Data}
+}
+
+func (chunk *OutputChunk) GetClientInfo() HostInfo {
+	return HostInfo{ID: chunk.ID, Name: chunk.Name}
+}
+
+//ActionResult is the outcome of a single action in a job, Index is its position in the job's actions
+type ActionResult struct {
+	Index  int
+	Action string
+	Output string
+	Error  string
+}
+
+func (result *ClientResult) GetResults() []string {
+	var results []string
+	for _, action := range result.Actions {
+		results = append(results, action.Output)
+	}
+	return results
 }
 
 func (result *ClientResult) GetClientInfo() HostInfo {
-	hostinfo := HostInfo{Name: result.Name}
+	hostinfo := HostInfo{ID: result.ID, Name: result.Name}
 	return hostinfo
 }
 
 type ClientStatus struct {
+	ID      string
 	Name    string
 	Message string
 }
 
-func (status *ClientStatus) GetResult() []string {
+func (status *ClientStatus) GetResults() []string {
 	return []string{status.Message}
 }
 
 func (status *ClientStatus) GetClientInfo() HostInfo {
-	hostinfo := HostInfo{Name: status.Name}
+	hostinfo := HostInfo{ID: status.ID, Name: status.Name}
 	return hostinfo
 }
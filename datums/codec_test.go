@@ -0,0 +1,208 @@
+package datums
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodecsRoundTripEnvelopes(t *testing.T) {
+	chunk := &OutputChunk{ID: "web-1", JID: "j1", Stream: "stdout", Seq: 3, Data: "hello\n"}
+	for _, name := range SupportedCodecs {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, err := NewEnvelope(codec, chunk, "corr")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		//Monotonic clock readings don't survive any codec
+		env.Timestamp = env.Timestamp.Round(0)
+		var buf bytes.Buffer
+		if err := codec.NewEncoder(&buf).Encode(env); err != nil {
+			t.Fatalf("%s: encode: %v", name, err)
+		}
+		var got Envelope
+		if err := codec.NewDecoder(&buf).Decode(&got); err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		if !got.Timestamp.Equal(env.Timestamp) {
+			t.Fatalf("%s: timestamp %v, want %v", name, got.Timestamp, env.Timestamp)
+		}
+		got.Timestamp = env.Timestamp
+		if !reflect.DeepEqual(&got, env) {
+			t.Fatalf("%s: got %+v, want %+v", name, got, *env)
+		}
+		payload, err := got.Open(codec)
+		if err != nil {
+			t.Fatalf("%s: open: %v", name, err)
+		}
+		if !reflect.DeepEqual(payload, chunk) {
+			t.Fatalf("%s: payload %+v, want %+v", name, payload, chunk)
+		}
+	}
+}
+
+func TestProtobufDecodesSeveralFrames(t *testing.T) {
+	codec := protobufCodec{}
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := enc.Encode(&Envelope{Version: 1, ID: id, Kind: KindStatus, Timestamp: time.Unix(1, 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := codec.NewDecoder(&buf)
+	for _, id := range []string{"a", "b", "c"} {
+		var env Envelope
+		if err := dec.Decode(&env); err != nil {
+			t.Fatal(err)
+		}
+		if env.ID != id {
+			t.Fatalf("got envelope %q, want %q", env.ID, id)
+		}
+	}
+}
+
+func TestProtobufRefusesOversizeFrames(t *testing.T) {
+	var buf bytes.Buffer
+	var prefix [binary.MaxVarintLen64]byte
+	buf.Write(prefix[:binary.PutUvarint(prefix[:], maxFrameSize+1)])
+	var env Envelope
+	err := protobufCodec{}.NewDecoder(&buf).Decode(&env)
+	if err == nil || !strings.Contains(err.Error(), errMalformedFrame.Error()) {
+		t.Fatalf("oversize frame gave %v", err)
+	}
+}
+
+func TestProtobufCarriesTheLargestPayload(t *testing.T) {
+	env := &Envelope{Version: 1, ID: "big", Kind: KindOutput, CorrelationID: "corr", Payload: make([]byte, MaxPayloadSize)}
+	var buf bytes.Buffer
+	if err := (protobufCodec{}).NewEncoder(&buf).Encode(env); err != nil {
+		t.Fatal(err)
+	}
+	var got Envelope
+	if err := (protobufCodec{}).NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Payload) != MaxPayloadSize {
+		t.Fatalf("got %d byte payload", len(got.Payload))
+	}
+}
+
+func TestProtobufRejectsMalformedFrames(t *testing.T) {
+	frames := map[string][]byte{
+		"truncated length": {0x0a, 0x12, 0x05, 'a'},
+		"bad wire type":    {0x02, 0x0b, 0x00},
+		"truncated varint": {0x02, 0x08, 0x80},
+	}
+	for name, frame := range frames {
+		var env Envelope
+		if err := (protobufCodec{}).NewDecoder(bytes.NewReader(frame)).Decode(&env); err == nil {
+			t.Errorf("%s: decoded %+v", name, env)
+		}
+	}
+}
+
+func TestProtobufOnlyFramesEnvelopes(t *testing.T) {
+	if err := (protobufCodec{}).NewEncoder(&bytes.Buffer{}).Encode(&Hello{}); err == nil {
+		t.Fatal("framed a bare message")
+	}
+}
+
+func TestOpenRefusesOversizePayloads(t *testing.T) {
+	env := &Envelope{Version: ProtocolVersion, Kind: KindOutput, Payload: make([]byte, MaxPayloadSize+1)}
+	if _, err := env.Open(Gob); err != errPayloadTooLarge {
+		t.Fatalf("got %v, want %v", err, errPayloadTooLarge)
+	}
+}
+
+func TestProtobufRoundTripsEveryKind(t *testing.T) {
+	payloads := []interface{}{
+		&CommandRunner{JID: "j1", Sequence: 2, Type: "command", Actions: []string{"uptime", ""}, Targets: []string{"web-*"}},
+		&ClientStatus{ID: "web-1", Name: "web", Message: "ok"},
+		&ClientResult{ID: "web-1", Name: "web", JID: "j1",
+			Actions:    []ActionResult{{Index: 0, Action: "uptime", Output: "up"}, {}, {Index: 2, Error: "exit status 1"}},
+			Controller: ControllerResult{Hostname: "web"}},
+		&ErrorMessage{Message: "unknown kind"},
+		&OutputChunk{ID: "web-1", JID: "j1", Index: -1, Stream: StreamStderr, Seq: 7, Data: "\xff\x00partial"},
+		&Facts{ID: "web-1", Labels: map[string]string{"role": "web", "": "empty"}, Facts: map[string]string{"os": "linux", "kernel": ""}},
+		&Hello{MinVersion: 1, MaxVersion: 4, BuildVersion: "v1", Codecs: SupportedCodecs, Compression: SupportedCompression,
+			Modules: SupportedModules, HeartbeatInterval: 30 * time.Second},
+		&HelloAck{Version: 4, Codec: CodecProtobuf, Compression: CompressionNone, Modules: []string{"command"}, HeartbeatInterval: time.Minute},
+	}
+	codec := protobufCodec{}
+	for _, payload := range payloads {
+		kind, err := KindOf(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := codec.Marshal(payload)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		got := reflect.New(reflect.TypeOf(payload).Elem()).Interface()
+		if err := codec.Unmarshal(data, got); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if !reflect.DeepEqual(got, payload) {
+			t.Errorf("%s: got %+v, want %+v", kind, got, payload)
+		}
+	}
+}
+
+//Bytes worked out by hand from the protobuf encoding rules for the messages in envelope.proto
+func TestProtobufWireFormat(t *testing.T) {
+	tests := []struct {
+		payload interface{}
+		want    []byte
+	}{
+		{&ClientStatus{ID: "a", Message: "ok"}, []byte{0x0a, 0x01, 'a', 0x1a, 0x02, 'o', 'k'}},
+		{&CommandRunner{Sequence: 1, Actions: []string{"ls", ""}}, []byte{0x10, 0x01, 0x22, 0x02, 'l', 's', 0x22, 0x00}},
+		{&Facts{Labels: map[string]string{"k": "v"}}, []byte{0x1a, 0x06, 0x0a, 0x01, 'k', 0x12, 0x01, 'v'}},
+		{&ClientResult{Actions: []ActionResult{{Index: 1}}}, []byte{0x22, 0x02, 0x08, 0x01}},
+		{&HelloAck{HeartbeatInterval: time.Second}, []byte{0x30, 0x80, 0x94, 0xeb, 0xdc, 0x03}},
+	}
+	for _, test := range tests {
+		got, err := protobufCodec{}.Marshal(test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%T: got % x, want % x", test.payload, got, test.want)
+		}
+	}
+}
+
+func TestProtobufSkipsUnknownFields(t *testing.T) {
+	data := []byte{
+		0x0a, 0x01, 'a', //id
+		0x78, 0x05, //field 15 varint
+		0x81, 0x01, 1, 2, 3, 4, 5, 6, 7, 8, //field 16 fixed64
+		0x8d, 0x01, 1, 2, 3, 4, //field 17 fixed32
+		0x1a, 0x02, 'o', 'k', //message
+	}
+	var status ClientStatus
+	if err := (protobufCodec{}).Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != "a" || status.Message != "ok" {
+		t.Fatalf("got %+v", status)
+	}
+	if err := (protobufCodec{}).Unmarshal([]byte{0x0a, 0x05, 'a'}, &status); err == nil {
+		t.Fatal("decoded a truncated message")
+	}
+}
+
+func TestProtobufRefusesUnknownTypes(t *testing.T) {
+	if _, err := (protobufCodec{}).Marshal(&FactsReq{}); err == nil {
+		t.Fatal("marshalled a type without an encoding")
+	}
+	if err := (protobufCodec{}).Unmarshal(nil, &FactsReq{}); err == nil {
+		t.Fatal("unmarshalled a type without an encoding")
+	}
+}
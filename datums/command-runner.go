@@ -1,12 +1,21 @@
 package datums
 
 import (
+	"bufio"
+	"context"
+	"io"
 	"log"
 	"os/exec"
 	"strings"
+	"sync"
 )
 
+//Longest piece of output sent in one chunk
+const maxOutputChunk = 64 << 10
+
 type CommandRunner struct {
+	//JID is assigned by the master when the runner is dispatched
+	JID      string   `yaml:"-"`
 	Sequence int      `yaml:"sequence"`
 	Type     string   `yaml:"type"`
 	Actions  []string `yaml:"actions"`
@@ -21,22 +30,89 @@ func (runner *CommandRunner) GetType() string {
 	return runner.Type
 }
 
-func (runner *CommandRunner) Execute() ([]string, error) {
-	var result []string
-	for _, action := range runner.Actions {
+func (runner *CommandRunner) GetJID() string {
+	return runner.JID
+}
+
+//Execute runs every action in order, a failed action is reported in its result and doesn't stop the rest
+func (runner *CommandRunner) Execute(ctx context.Context, output OutputFunc) ([]ActionResult, error) {
+	var results []ActionResult
+	for i, action := range runner.Actions {
+		result := ActionResult{Index: i, Action: action}
+		if ctx.Err() != nil {
+			result.Error = "cancelled"
+			results = append(results, result)
+			continue
+		}
 		log.Println("Running:")
 		log.Println(action)
 		descmd := strings.Fields(action)
+		if len(descmd) == 0 {
+			result.Error = "empty action"
+			results = append(results, result)
+			continue
+		}
 		bin, err := exec.LookPath(descmd[0])
 		if err != nil {
 			log.Println(err)
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
 		}
-		cmd := exec.Command(bin, descmd[1:]...)
-		out, err := cmd.CombinedOutput()
+		result.Output, err = runAction(i, exec.CommandContext(ctx, bin, descmd[1:]...), output)
 		if err != nil {
-			log.Fatalf("cmd.Run() failed with %s\n", err)
+			log.Printf("cmd.Run() failed with %s\n", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+//Run a command, streaming its output when there is somewhere to send it
+func runAction(index int, cmd *exec.Cmd, output OutputFunc) (string, error) {
+	if output == nil {
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go streamOutput(&wg, stdout, func(data []byte) { output(index, StreamStdout, data) })
+	go streamOutput(&wg, stderr, func(data []byte) { output(index, StreamStderr, data) })
+	//The pipes have to be drained before Wait closes them
+	wg.Wait()
+	return "", cmd.Wait()
+}
+
+//Hand output on a line at a time as it is written.  Lines that are already waiting are sent together
+//so a chatty command doesn't become a message per line, lines longer than a chunk are split.
+func streamOutput(wg *sync.WaitGroup, r io.Reader, fn func([]byte)) {
+	defer wg.Done()
+	reader := bufio.NewReaderSize(r, maxOutputChunk)
+	var chunk []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		chunk = append(chunk, line...)
+		if err != nil && err != bufio.ErrBufferFull {
+			if len(chunk) > 0 {
+				fn(chunk)
+			}
+			return
+		}
+		if reader.Buffered() == 0 || len(chunk) >= maxOutputChunk {
+			fn(chunk)
+			chunk = nil
 		}
-		result = append(result, string(out))
 	}
-	return result, nil
 }
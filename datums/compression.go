@@ -0,0 +1,114 @@
+package datums
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//Compression names, offered in this order of preference
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+//MaxPayloadSize is the largest payload an envelope may carry, compressed payloads may not expand past it either
+const MaxPayloadSize = 64 << 20
+
+var errPayloadTooLarge = errors.New("payload too large")
+
+//Compressor compresses envelope payloads
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	//Decompress refuses to return more than limit bytes
+	Decompress(data []byte, limit int64) ([]byte, error)
+}
+
+var compressors = map[string]Compressor{
+	CompressionZstd: zstdCompressor{},
+	CompressionGzip: gzipCompressor{},
+}
+
+//GetCompressor looks up a compressor by name, none is nil
+func GetCompressor(name string) (Compressor, error) {
+	if name == "" || name == CompressionNone {
+		return nil, nil
+	}
+	compressor, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+	return compressor, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return CompressionGzip
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte, limit int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errPayloadTooLarge
+	}
+	return out, nil
+}
+
+//EncodeAll is safe to call from every stream at once, so one encoder is shared.  NewWriter only fails
+//on bad options.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Name() string {
+	return CompressionZstd
+}
+
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (zstdCompressor) Decompress(data []byte, limit int64) ([]byte, error) {
+	//Frames asking for a window larger than the largest payload are refused before it is allocated
+	r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(MaxPayloadSize))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errPayloadTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,96 @@
+package datums
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressOnlyAtThreshold(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 100)
+	tests := []struct {
+		threshold int
+		want      string
+	}{
+		{threshold: 101, want: ""},
+		{threshold: 100, want: CompressionGzip},
+		{threshold: 0, want: CompressionGzip},
+	}
+	for _, test := range tests {
+		env := &Envelope{Payload: payload}
+		if err := env.Compress(CompressionGzip, test.threshold); err != nil {
+			t.Fatal(err)
+		}
+		if env.Compression != test.want {
+			t.Errorf("threshold %d: compression %q, want %q", test.threshold, env.Compression, test.want)
+		}
+	}
+}
+
+func TestCompressKeepsPayloadsThatDontShrink(t *testing.T) {
+	env := &Envelope{Payload: []byte("x")}
+	if err := env.Compress(CompressionGzip, 0); err != nil {
+		t.Fatal(err)
+	}
+	if env.Compression != "" || string(env.Payload) != "x" {
+		t.Fatalf("got %q compressed with %q", env.Payload, env.Compression)
+	}
+}
+
+func TestCompressNone(t *testing.T) {
+	env := &Envelope{Payload: bytes.Repeat([]byte("a"), 100)}
+	if err := env.Compress(CompressionNone, 0); err != nil {
+		t.Fatal(err)
+	}
+	if env.Compression != "" {
+		t.Fatalf("compressed with %q", env.Compression)
+	}
+	if err := env.Compress("lz4", 0); err == nil {
+		t.Fatal("unknown compression was accepted")
+	}
+}
+
+func TestCompressedEnvelopeOpens(t *testing.T) {
+	chunk := &OutputChunk{ID: "web-1", Data: strings.Repeat("output ", 200)}
+	for _, name := range []string{CompressionZstd, CompressionGzip} {
+		env, err := NewEnvelope(Gob, chunk, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := env.Compress(name, 0); err != nil {
+			t.Fatal(err)
+		}
+		if env.Compression != name {
+			t.Fatalf("%s: payload wasn't compressed", name)
+		}
+		payload, err := env.Open(Gob)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if payload.(*OutputChunk).Data != chunk.Data {
+			t.Fatalf("%s: payload changed on the way through", name)
+		}
+	}
+}
+
+func TestDecompressStopsAtLimit(t *testing.T) {
+	for _, compressor := range []Compressor{zstdCompressor{}, gzipCompressor{}} {
+		data, err := compressor.Compress(make([]byte, 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := compressor.Decompress(data, 999); err == nil {
+			t.Fatalf("%s: decompressed past the limit", compressor.Name())
+		}
+		out, err := compressor.Decompress(data, 1000)
+		if err != nil || len(out) != 1000 {
+			t.Fatalf("%s: got %d bytes, %v", compressor.Name(), len(out), err)
+		}
+	}
+}
+
+func TestZstdRejectsGarbage(t *testing.T) {
+	if _, err := (zstdCompressor{}).Decompress([]byte("not zstd at all"), MaxPayloadSize); err == nil {
+		t.Fatal("decompressed garbage")
+	}
+}
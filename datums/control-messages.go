@@ -1,6 +1,8 @@
 package datums
 
 import (
+	"time"
+
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/host"
@@ -9,21 +11,69 @@ import (
 	"github.com/shirou/gopsutil/net"
 )
 
+//SocketReq is what gets written to the domain socket, only one field should be set
+type SocketReq struct {
+	Control  *ControllerReq
+	Keys     *KeyReq
+	Tokens   *TokenReq
+	Presence *PresenceReq
+	Facts    *FactsReq
+	Groups   *GroupsReq
+}
+
+//Ways a control request's pattern is matched against minion IDs and hostnames
+const (
+	MatchRegex = "regex"
+	MatchGlob  = "glob"
+	MatchList  = "list"
+	//Compound expressions are parsed by the target package
+	MatchCompound = "compound"
+)
+
 type ControllerReq struct {
 	Pattern string
+	//How the pattern is matched, regex when empty
+	Match string
+	//Labels and facts the targets must also have, values are globs
+	Labels map[string]string
+	Facts  map[string]string
+	//Node group the targets must be in
+	Group string
+	//Target every minion, a request that targets nothing else is refused without it
+	All     bool
+	Actions []string
+	//Only report the targets, nothing is run
+	DryRun bool
+	//How long to wait for the targeted minions to answer
+	Timeout time.Duration
+}
+
+//JobEvent is streamed back to the control command while a job runs.  The first event lists the
+//targets and any listed minions that aren't connected, output follows as it happens, one result for
+//each minion that answers and the last event lists the targets that didn't.
+type JobEvent struct {
+	JID     string
+	Targets []string
+	Offline []string
+	Output  *OutputChunk
+	Result  *ClientResult
+	Done    bool
+	Missing []string
+	Error   string
 }
 
+//ControllerResult is the system info of a minion, the JSON names are the keys its facts are flattened to
 type ControllerResult struct {
-	Hostname    string
-	Host        host.InfoStat
-	CPU         []cpu.InfoStat
-	DiskUsage   disk.UsageStat
-	DiskPart    []disk.PartitionStat
-	LoadAverage load.AvgStat
-	MiscStat    load.MiscStat
-	VirtMem     mem.VirtualMemoryStat
-	SwapMem     mem.SwapMemoryStat
-	Interfaces  []net.InterfaceStat
+	Hostname    string                `json:"hostname"`
+	Host        host.InfoStat         `json:"host"`
+	CPU         []cpu.InfoStat        `json:"cpu"`
+	DiskUsage   disk.UsageStat        `json:"diskUsage"`
+	DiskPart    []disk.PartitionStat  `json:"diskPart"`
+	LoadAverage load.AvgStat          `json:"loadAverage"`
+	MiscStat    load.MiscStat         `json:"miscStat"`
+	VirtMem     mem.VirtualMemoryStat `json:"virtMem"`
+	SwapMem     mem.SwapMemoryStat    `json:"swapMem"`
+	Interfaces  []net.InterfaceStat   `json:"interfaces"`
 }
 
 type ControlMessage struct {
@@ -36,6 +86,7 @@ func (sysinfo *ControllerResult) GetSystemInfo() error {
 		return err
 	}
 	sysinfo.Host = *hostInfo
+	sysinfo.Hostname = hostInfo.Hostname
 	cpuInfo, err := cpu.Info()
 	if err != nil {
 		return err
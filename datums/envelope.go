@@ -0,0 +1,178 @@
+package datums
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//ProtocolVersion is the newest envelope version this build speaks.  Version 2 streams job output,
+//version 3 runs each job on its own channel and version 4 has minions report their facts.
+const ProtocolVersion = 4
+
+//Kinds of payload carried in an Envelope
+const (
+	KindCommand = "command"
+	KindStatus  = "status"
+	KindResult  = "result"
+	KindError   = "error"
+	KindOutput  = "output"
+	KindFacts   = "facts"
+	//Hello and its answer open every channel, they are decoded the same way in every version
+	KindHello    = "hello"
+	KindHelloAck = "hello-ack"
+)
+
+var (
+	//ErrUnsupportedVersion is returned when an envelope was written by an incompatible protocol version
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	//ErrUnknownKind is returned when an envelope carries a payload kind that isn't registered
+	ErrUnknownKind = errors.New("unknown payload kind")
+)
+
+//Envelope wraps every message on the wire so either side can tell what it is before decoding it
+type Envelope struct {
+	Version int
+	ID      string
+	Kind    string
+	//CorrelationID is the ID of the envelope this one answers
+	CorrelationID string
+	Timestamp     time.Time
+	//Compression of the payload, empty when it isn't compressed
+	Compression string
+	Payload     []byte
+}
+
+//ErrorMessage tells the other side a message it sent couldn't be handled
+type ErrorMessage struct {
+	Message string
+}
+
+var kinds = struct {
+	sync.RWMutex
+	factories map[string]func() interface{}
+	byType    map[reflect.Type]string
+}{
+	factories: make(map[string]func() interface{}),
+	byType:    make(map[reflect.Type]string),
+}
+
+func init() {
+	RegisterKind(KindCommand, func() interface{} { return &CommandRunner{} })
+	RegisterKind(KindStatus, func() interface{} { return &ClientStatus{} })
+	RegisterKind(KindResult, func() interface{} { return &ClientResult{} })
+	RegisterKind(KindError, func() interface{} { return &ErrorMessage{} })
+	RegisterKind(KindOutput, func() interface{} { return &OutputChunk{} })
+	RegisterKind(KindFacts, func() interface{} { return &Facts{} })
+	RegisterKind(KindHello, func() interface{} { return &Hello{} })
+	RegisterKind(KindHelloAck, func() interface{} { return &HelloAck{} })
+}
+
+//RegisterKind adds a payload kind, factory returns a pointer to a new zero value to decode into
+func RegisterKind(kind string, factory func() interface{}) {
+	kinds.Lock()
+	defer kinds.Unlock()
+	kinds.factories[kind] = factory
+	kinds.byType[reflect.TypeOf(factory())] = kind
+}
+
+//KindOf returns the registered kind of a payload
+func KindOf(payload interface{}) (string, error) {
+	kinds.RLock()
+	defer kinds.RUnlock()
+	kind, ok := kinds.byType[reflect.TypeOf(payload)]
+	if !ok {
+		return "", fmt.Errorf("%v: %T", ErrUnknownKind, payload)
+	}
+	return kind, nil
+}
+
+//NewEnvelope wraps a registered payload encoded with the stream's codec, correlationID is empty
+//unless it answers another envelope
+func NewEnvelope(codec Codec, payload interface{}, correlationID string) (*Envelope, error) {
+	kind, err := KindOf(payload)
+	if err != nil {
+		return nil, err
+	}
+	data, err := codec.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	id, err := NewMessageID()
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Version:       ProtocolVersion,
+		ID:            id,
+		Kind:          kind,
+		CorrelationID: correlationID,
+		Timestamp:     time.Now(),
+		Payload:       data,
+	}, nil
+}
+
+//Compress the payload when it is at least threshold bytes and compressing makes it smaller
+func (env *Envelope) Compress(name string, threshold int) error {
+	compressor, err := GetCompressor(name)
+	if err != nil || compressor == nil || len(env.Payload) < threshold || env.Compression != "" {
+		return err
+	}
+	data, err := compressor.Compress(env.Payload)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(env.Payload) {
+		env.Payload = data
+		env.Compression = compressor.Name()
+	}
+	return nil
+}
+
+//Open checks the version and decodes the payload into a new value of its kind
+func (env *Envelope) Open(codec Codec) (interface{}, error) {
+	hello := env.Kind == KindHello || env.Kind == KindHelloAck
+	if !hello && (env.Version < MinProtocolVersion || env.Version > ProtocolVersion) {
+		return nil, fmt.Errorf("%v: %d", ErrUnsupportedVersion, env.Version)
+	}
+	kinds.RLock()
+	factory, ok := kinds.factories[env.Kind]
+	kinds.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%v: %q", ErrUnknownKind, env.Kind)
+	}
+	data := env.Payload
+	if len(data) > MaxPayloadSize {
+		return nil, errPayloadTooLarge
+	}
+	if env.Compression != "" {
+		compressor, err := GetCompressor(env.Compression)
+		if err != nil {
+			return nil, err
+		}
+		if compressor != nil {
+			data, err = compressor.Decompress(data, MaxPayloadSize)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	payload := factory()
+	if err := codec.Unmarshal(data, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+//NewMessageID returns a random ID for an envelope
+func NewMessageID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
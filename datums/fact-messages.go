@@ -0,0 +1,83 @@
+package datums
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+//Facts is what a minion reports about itself once the hello is done.  Labels come from its config,
+//facts are gathered from the system and flattened to dotted keys such as host.platformVersion.
+type Facts struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+	Facts  map[string]string
+}
+
+//FactsReq asks the server for the labels and facts of the connected minions, Pattern is a glob on the
+//minion ID or hostname
+type FactsReq struct {
+	Pattern string
+}
+
+//FactsResult is returned by the server for a FactsReq
+type FactsResult struct {
+	Minions []Facts
+	Error   string
+}
+
+//GatherFacts collects the system info of this host as flattened facts, whatever was gathered before
+//an error is still returned
+func GatherFacts() (map[string]string, error) {
+	var sysinfo ControllerResult
+	infoErr := sysinfo.GetSystemInfo()
+	data, err := json.Marshal(&sysinfo)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	err = json.Unmarshal(data, &tree)
+	if err != nil {
+		return nil, err
+	}
+	facts := make(map[string]string)
+	flattenFacts("", tree, facts)
+	return facts, infoErr
+}
+
+//Flatten nested objects and lists into keys joined with dots, list entries are keyed by index
+func flattenFacts(prefix string, value interface{}, facts map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenFacts(join(key), child, facts)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenFacts(join(strconv.Itoa(i)), child, facts)
+		}
+	case string:
+		facts[prefix] = v
+	case float64:
+		facts[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		facts[prefix] = strconv.FormatBool(v)
+	}
+}
+
+//SortedKeys returns the keys of labels or facts in order
+func SortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
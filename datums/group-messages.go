@@ -0,0 +1,19 @@
+package datums
+
+//GroupsReq asks the server for the node groups it has defined, Pattern is a glob on the group name
+type GroupsReq struct {
+	Pattern string
+}
+
+//NodeGroup is a named target expression defined on the master and the minions it matches now
+type NodeGroup struct {
+	Name    string
+	Expr    string
+	Minions []string
+}
+
+//GroupsResult is returned by the server for a GroupsReq
+type GroupsResult struct {
+	Groups []NodeGroup
+	Error  string
+}
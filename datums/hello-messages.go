@@ -0,0 +1,143 @@
+package datums
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//MinProtocolVersion is the oldest envelope version this build still speaks
+const MinProtocolVersion = 1
+
+//What this build supports, in order of preference
+var (
+	SupportedCodecs      = []string{CodecGob, CodecJSON, CodecProtobuf}
+	SupportedCompression = []string{CompressionZstd, CompressionGzip, CompressionNone}
+	SupportedModules     = []string{"command"}
+)
+
+//ErrNoCommonCodec is returned when a minion and master share no codec or compression
+var ErrNoCommonCodec = errors.New("no codec in common")
+
+//Hello is the first message a minion sends on a channel, it announces what the minion can speak
+type Hello struct {
+	MinVersion   int
+	MaxVersion   int
+	BuildVersion string
+	Codecs       []string
+	Compression  []string
+	Modules      []string
+	//How often the minion sends a heartbeat, zero for minions that don't say
+	HeartbeatInterval time.Duration
+}
+
+//HelloAck is the master's answer to a Hello with what both sides will use
+type HelloAck struct {
+	Version      int
+	BuildVersion string
+	Codec        string
+	Compression  string
+	Modules      []string
+	//How often the master expects a heartbeat from the minion
+	HeartbeatInterval time.Duration
+}
+
+//NewHello announces everything this build supports
+func NewHello(buildVersion string) *Hello {
+	return &Hello{
+		MinVersion:   MinProtocolVersion,
+		MaxVersion:   ProtocolVersion,
+		BuildVersion: buildVersion,
+		Codecs:       SupportedCodecs,
+		Compression:  SupportedCompression,
+		Modules:      SupportedModules,
+	}
+}
+
+//LegacyHello is assumed for minions that start talking without a hello
+func LegacyHello() *Hello {
+	return &Hello{
+		MinVersion:  1,
+		MaxVersion:  1,
+		Codecs:      []string{CodecGob},
+		Compression: []string{CompressionNone},
+		Modules:     []string{"command"},
+	}
+}
+
+//Negotiate picks the newest version both sides speak and the minion's first choice of the codecs and
+//compression the master allows
+func (hello *Hello) Negotiate(buildVersion string, codecs, compression []string) (*HelloAck, error) {
+	version := ProtocolVersion
+	if hello.MaxVersion < version {
+		version = hello.MaxVersion
+	}
+	if version < MinProtocolVersion || version < hello.MinVersion {
+		return nil, fmt.Errorf("%v: minion speaks %d-%d, master speaks %d-%d", ErrUnsupportedVersion,
+			hello.MinVersion, hello.MaxVersion, MinProtocolVersion, ProtocolVersion)
+	}
+	codec := firstCommon(hello.Codecs, codecs)
+	if codec == "" {
+		return nil, fmt.Errorf("%v: minion offered %v", ErrNoCommonCodec, hello.Codecs)
+	}
+	//Minions that don't list compression don't compress
+	compress := CompressionNone
+	if len(hello.Compression) > 0 {
+		compress = firstCommon(hello.Compression, compression)
+		if compress == "" {
+			return nil, fmt.Errorf("%v: minion offered compression %v", ErrNoCommonCodec, hello.Compression)
+		}
+	}
+	ack := &HelloAck{
+		Version:      version,
+		BuildVersion: buildVersion,
+		Codec:        codec,
+		Compression:  compress,
+	}
+	for _, module := range hello.Modules {
+		if contains(SupportedModules, module) {
+			ack.Modules = append(ack.Modules, module)
+		}
+	}
+	return ack, nil
+}
+
+//MaxHeartbeatInterval is the slowest heartbeat a minion can ask for, one announcing a slower heartbeat
+//is still expected this often so it can't keep itself from ever being marked lost
+const MaxHeartbeatInterval = 5 * time.Minute
+
+//Heartbeat picks the slower of the minion's heartbeat and the one the master expects, so a minion
+//that sends them less often than the master would like isn't counted as missing them
+func (hello *Hello) Heartbeat(master time.Duration) time.Duration {
+	interval := hello.HeartbeatInterval
+	if interval > MaxHeartbeatInterval {
+		interval = MaxHeartbeatInterval
+	}
+	if interval > master {
+		return interval
+	}
+	return master
+}
+
+//HasModule checks if both sides agreed on a module type
+func (ack *HelloAck) HasModule(module string) bool {
+	return contains(ack.Modules, module)
+}
+
+func firstCommon(preferred, supported []string) string {
+	for _, value := range preferred {
+		if contains(supported, value) {
+			return value
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package datums
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		//Schemes the master doesn't know are skipped, newer minions may offer more
+		{[]string{"lz4", CompressionGzip, CompressionNone}, CompressionGzip},
+		{SupportedCompression, CompressionZstd},
+		//Minions from before zstd only offer gzip, they keep getting it
+		{[]string{CompressionGzip, CompressionNone}, CompressionGzip},
+		{[]string{CompressionNone, CompressionGzip}, CompressionNone},
+		//Minions that predate compression don't list any
+		{nil, CompressionNone},
+	}
+	for _, test := range tests {
+		hello := NewHello("test")
+		hello.Compression = test.offered
+		ack, err := hello.Negotiate("master", SupportedCodecs, SupportedCompression)
+		if err != nil {
+			t.Fatalf("%v: %v", test.offered, err)
+		}
+		if ack.Compression != test.want {
+			t.Errorf("%v: agreed on %q, want %q", test.offered, ack.Compression, test.want)
+		}
+	}
+	hello := NewHello("test")
+	hello.Compression = []string{"lz4"}
+	if _, err := hello.Negotiate("master", SupportedCodecs, SupportedCompression); err == nil {
+		t.Error("agreed on a compression the master doesn't support")
+	}
+}
+
+func TestNegotiateVersionAndCodec(t *testing.T) {
+	ack, err := LegacyHello().Negotiate("master", SupportedCodecs, SupportedCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Version != 1 || ack.Codec != CodecGob || ack.Compression != CompressionNone {
+		t.Errorf("legacy minion got %+v", ack)
+	}
+	hello := NewHello("test")
+	hello.Codecs = []string{CodecProtobuf, CodecGob}
+	ack, err = hello.Negotiate("master", SupportedCodecs, SupportedCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Version != ProtocolVersion || ack.Codec != CodecProtobuf {
+		t.Errorf("got %+v", ack)
+	}
+	hello.MinVersion = ProtocolVersion + 1
+	hello.MaxVersion = ProtocolVersion + 1
+	if _, err := hello.Negotiate("master", SupportedCodecs, SupportedCompression); err == nil {
+		t.Error("agreed with a minion that is too new")
+	}
+}
+
+func TestHeartbeatUsesTheSlowerInterval(t *testing.T) {
+	tests := []struct {
+		minion, master, want time.Duration
+	}{
+		{10 * time.Second, 2 * time.Second, 10 * time.Second},
+		{time.Second, 2 * time.Second, 2 * time.Second},
+		//Minions from before the interval was announced get the master's
+		{0, 2 * time.Second, 2 * time.Second},
+		{-time.Second, 2 * time.Second, 2 * time.Second},
+		//A minion can't announce a heartbeat so slow it is never lost
+		{1000 * time.Hour, 2 * time.Second, MaxHeartbeatInterval},
+	}
+	for _, test := range tests {
+		hello := &Hello{HeartbeatInterval: test.minion}
+		if got := hello.Heartbeat(test.master); got != test.want {
+			t.Errorf("minion %s, master %s: got %s, want %s", test.minion, test.master, got, test.want)
+		}
+	}
+	if got := LegacyHello().Heartbeat(time.Second); got != time.Second {
+		t.Errorf("legacy minion got %s", got)
+	}
+}
@@ -0,0 +1,65 @@
+package datums
+
+import (
+	"time"
+)
+
+const (
+	KeyStateAuthorized = "authorized"
+	KeyStatePending    = "pending"
+	KeyStateRejected   = "rejected"
+	KeyStateRevoked    = "revoked"
+	KeyStateNext       = "next"
+
+	KeyActionList   = "list"
+	KeyActionAccept = "accept"
+	KeyActionReject = "reject"
+	KeyActionRevoke = "revoke"
+	KeyActionDelete = "delete"
+	KeyActionRotate = "rotate"
+)
+
+//KeyReq asks the server to list or change the state of minion keys
+type KeyReq struct {
+	Action  string
+	Pattern string
+	All     bool
+	//Master rotates the server's own host key instead of minion keys
+	Master bool
+	//Grace is how long the old host key is still served after a master rotation
+	Grace time.Duration
+	//By is who asked for the change, it is recorded in the key's history
+	By string
+}
+
+//KeyEntry is a minion's key, the state it is in and what is known about it
+type KeyEntry struct {
+	ID           string
+	Fingerprint  string
+	State        string
+	Labels       map[string]string
+	PublicKey    string
+	Hostname     string
+	SourceIP     string
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	AcceptedBy   string
+	AcceptedAt   time.Time
+	BuildVersion string
+	Protocol     int
+	History      []KeyEvent
+}
+
+//KeyEvent is a single change in a key's history
+type KeyEvent struct {
+	Time  time.Time
+	State string
+	By    string
+	Note  string
+}
+
+//KeyResult is returned by the server for a KeyReq
+type KeyResult struct {
+	Keys  []KeyEntry
+	Error string
+}
@@ -1,16 +1,26 @@
 package datums
 
+import "context"
+
 type ServerMessage interface {
 	GetSequence() int
 	GetType() string
-	Execute() ([]string, error)
+	GetJID() string
+	//Execute hands output to the OutputFunc as it is produced, results only carry output when it is nil.
+	//Cancelling ctx kills whatever is running.
+	Execute(ctx context.Context, output OutputFunc) ([]ActionResult, error)
 }
 
+//OutputFunc receives output from the action at index as it happens, stream is StreamStdout or StreamStderr
+type OutputFunc func(index int, stream string, data []byte)
+
 type ClientMessage interface {
 	GetClientInfo() HostInfo
 	GetResults() []string
 }
 
+//HostInfo identifies a minion, the ID is unique where the name may not be
 type HostInfo struct {
+	ID   string
 	Name string
 }
@@ -0,0 +1,34 @@
+package datums
+
+import "time"
+
+//Presence states of a minion
+const (
+	//PresenceUp minions are connected and sending heartbeats
+	PresenceUp = "up"
+	//PresenceDown minions aren't connected, either they disconnected or haven't connected since the master started
+	PresenceDown = "down"
+	//PresenceLost minions stopped sending heartbeats and were disconnected by the master
+	PresenceLost = "lost"
+)
+
+//PresenceReq asks the server which minions are up, Pattern is a glob on the minion ID or hostname
+type PresenceReq struct {
+	Pattern string
+}
+
+//PresenceEntry is the presence of a single minion
+type PresenceEntry struct {
+	ID            string
+	Hostname      string
+	State         string
+	Since         time.Time
+	LastHeartbeat time.Time
+	Reason        string
+}
+
+//PresenceResult is returned by the server for a PresenceReq
+type PresenceResult struct {
+	Minions []PresenceEntry
+	Error   string
+}
@@ -0,0 +1,243 @@
+package datums
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+//Room for the envelope fields around the largest payload, frames over this are refused rather than allocated
+const maxFrameSize = MaxPayloadSize + 4<<10
+
+//Protobuf wire types, the messages in envelope.proto only write varints and length delimited fields
+//but fixed width ones are skipped so newer peers can add them
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformedFrame = errors.New("malformed envelope frame")
+
+//The protobuf codec writes envelopes and their payloads as the messages in envelope.proto, each
+//envelope prefixed with its length.  The encoding is written by hand so the build doesn't need protoc.
+type protobufCodec struct{}
+
+//Payloads encode themselves in the layout envelope.proto gives them
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto(msg []byte) error
+}
+
+func (protobufCodec) Name() string {
+	return CodecProtobuf
+}
+
+func (protobufCodec) NewEncoder(w io.Writer) Encoder {
+	return &framedEncoder{w: w}
+}
+
+func (protobufCodec) NewDecoder(r io.Reader) Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &framedDecoder{r: br}
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec has no encoding for %T", v)
+	}
+	return msg.marshalProto(), nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(protoMessage)
+	if !ok {
+		return fmt.Errorf("protobuf codec has no encoding for %T", v)
+	}
+	return msg.unmarshalProto(data)
+}
+
+type framedEncoder struct {
+	w io.Writer
+}
+
+func (enc *framedEncoder) Encode(v interface{}) error {
+	env, ok := v.(*Envelope)
+	if !ok {
+		return fmt.Errorf("protobuf codec only frames envelopes, got %T", v)
+	}
+	msg := marshalEnvelope(env)
+	frame := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(msg))
+	n := binary.PutUvarint(frame, uint64(len(msg)))
+	_, err := enc.w.Write(append(frame[:n], msg...))
+	return err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type framedDecoder struct {
+	r byteReader
+}
+
+func (dec *framedDecoder) Decode(v interface{}) error {
+	env, ok := v.(*Envelope)
+	if !ok {
+		return fmt.Errorf("protobuf codec only frames envelopes, got %T", v)
+	}
+	size, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		return err
+	}
+	if size > maxFrameSize {
+		return fmt.Errorf("%v: %d byte frame", errMalformedFrame, size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(dec.r, msg); err != nil {
+		return err
+	}
+	return unmarshalEnvelope(msg, env)
+}
+
+func marshalEnvelope(env *Envelope) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(env.Version))
+	b = appendBytesField(b, 2, []byte(env.ID))
+	b = appendBytesField(b, 3, []byte(env.Kind))
+	b = appendBytesField(b, 4, []byte(env.CorrelationID))
+	if !env.Timestamp.IsZero() {
+		var ts []byte
+		ts = appendVarintField(ts, 1, uint64(env.Timestamp.Unix()))
+		ts = appendVarintField(ts, 2, uint64(env.Timestamp.Nanosecond()))
+		b = appendBytesField(b, 5, ts)
+	}
+	b = appendBytesField(b, 6, env.Payload)
+	return appendBytesField(b, 7, []byte(env.Compression))
+}
+
+func unmarshalEnvelope(msg []byte, env *Envelope) error {
+	*env = Envelope{}
+	return eachField(msg, func(field, wire, value uint64, data []byte) (err error) {
+		switch {
+		case field == 1 && wire == wireVarint:
+			env.Version = int(int64(value))
+		case field == 2 && wire == wireBytes:
+			env.ID = string(data)
+		case field == 3 && wire == wireBytes:
+			env.Kind = string(data)
+		case field == 4 && wire == wireBytes:
+			env.CorrelationID = string(data)
+		case field == 5 && wire == wireBytes:
+			env.Timestamp, err = unmarshalTimestamp(data)
+		case field == 6 && wire == wireBytes:
+			env.Payload = append([]byte(nil), data...)
+		case field == 7 && wire == wireBytes:
+			env.Compression = string(data)
+		}
+		return err
+	})
+}
+
+//google.protobuf.Timestamp
+func unmarshalTimestamp(msg []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := eachField(msg, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			seconds = int64(value)
+		case field == 2 && wire == wireVarint:
+			nanos = int64(int32(value))
+		}
+		return nil
+	})
+	return time.Unix(seconds, nanos), err
+}
+
+//Call fn with every field of a message in the order they were written
+func eachField(msg []byte, fn func(field, wire, value uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		field, wire, value, data, rest, err := readField(msg)
+		if err != nil {
+			return err
+		}
+		msg = rest
+		if err := fn(field, wire, value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Read one field, varints come back in value and length delimited fields in data
+func readField(msg []byte) (field, wire, value uint64, data, rest []byte, err error) {
+	tag, n := binary.Uvarint(msg)
+	if n <= 0 {
+		return 0, 0, 0, nil, nil, errMalformedFrame
+	}
+	msg = msg[n:]
+	field, wire = tag>>3, tag&7
+	switch wire {
+	case wireVarint:
+		value, n = binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, 0, 0, nil, nil, errMalformedFrame
+		}
+		return field, wire, value, nil, msg[n:], nil
+	case wireBytes:
+		size, n := binary.Uvarint(msg)
+		if n <= 0 || size > uint64(len(msg)-n) {
+			return 0, 0, 0, nil, nil, errMalformedFrame
+		}
+		end := n + int(size)
+		return field, wire, 0, msg[n:end], msg[end:], nil
+	case wireFixed64, wireFixed32:
+		size := 8
+		if wire == wireFixed32 {
+			size = 4
+		}
+		if len(msg) < size {
+			return 0, 0, 0, nil, nil, errMalformedFrame
+		}
+		return field, wire, 0, nil, msg[size:], nil
+	}
+	return 0, 0, 0, nil, nil, fmt.Errorf("%v: unsupported wire type %d", errMalformedFrame, wire)
+}
+
+//proto3 leaves out fields holding their zero value
+func appendVarintField(b []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(field)<<3|wireVarint)
+	return appendUvarint(b, value)
+}
+
+//Repeated fields keep their empty elements
+func appendElement(b []byte, field int, data []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|wireBytes)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	if len(data) == 0 {
+		return b
+	}
+	return appendElement(b, field, data)
+}
+
+func appendUvarint(b []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	return append(b, buf[:n]...)
+}
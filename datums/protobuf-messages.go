@@ -0,0 +1,301 @@
+package datums
+
+import "time"
+
+//Protobuf encodings of the payload kinds, the field numbers are the ones in envelope.proto.  New
+//fields get new numbers, a number is never reused for something else.
+
+func (msg *ErrorMessage) marshalProto() []byte {
+	return appendStringField(nil, 1, msg.Message)
+}
+
+func (msg *ErrorMessage) unmarshalProto(data []byte) error {
+	*msg = ErrorMessage{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		if field == 1 && wire == wireBytes {
+			msg.Message = string(data)
+		}
+		return nil
+	})
+}
+
+func (status *ClientStatus) marshalProto() []byte {
+	b := appendStringField(nil, 1, status.ID)
+	b = appendStringField(b, 2, status.Name)
+	return appendStringField(b, 3, status.Message)
+}
+
+func (status *ClientStatus) unmarshalProto(data []byte) error {
+	*status = ClientStatus{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			status.ID = string(data)
+		case field == 2 && wire == wireBytes:
+			status.Name = string(data)
+		case field == 3 && wire == wireBytes:
+			status.Message = string(data)
+		}
+		return nil
+	})
+}
+
+func (runner *CommandRunner) marshalProto() []byte {
+	b := appendStringField(nil, 1, runner.JID)
+	b = appendIntField(b, 2, runner.Sequence)
+	b = appendStringField(b, 3, runner.Type)
+	b = appendStrings(b, 4, runner.Actions)
+	return appendStrings(b, 5, runner.Targets)
+}
+
+func (runner *CommandRunner) unmarshalProto(data []byte) error {
+	*runner = CommandRunner{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			runner.JID = string(data)
+		case field == 2 && wire == wireVarint:
+			runner.Sequence = int(int64(value))
+		case field == 3 && wire == wireBytes:
+			runner.Type = string(data)
+		case field == 4 && wire == wireBytes:
+			runner.Actions = append(runner.Actions, string(data))
+		case field == 5 && wire == wireBytes:
+			runner.Targets = append(runner.Targets, string(data))
+		}
+		return nil
+	})
+}
+
+func (result *ActionResult) marshalProto() []byte {
+	b := appendIntField(nil, 1, result.Index)
+	b = appendStringField(b, 2, result.Action)
+	b = appendStringField(b, 3, result.Output)
+	return appendStringField(b, 4, result.Error)
+}
+
+func (result *ActionResult) unmarshalProto(data []byte) error {
+	*result = ActionResult{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			result.Index = int(int64(value))
+		case field == 2 && wire == wireBytes:
+			result.Action = string(data)
+		case field == 3 && wire == wireBytes:
+			result.Output = string(data)
+		case field == 4 && wire == wireBytes:
+			result.Error = string(data)
+		}
+		return nil
+	})
+}
+
+//Minions report their system info as facts, only the hostname of a result's Controller is carried
+func (result *ClientResult) marshalProto() []byte {
+	b := appendStringField(nil, 1, result.ID)
+	b = appendStringField(b, 2, result.Name)
+	b = appendStringField(b, 3, result.JID)
+	for i := range result.Actions {
+		b = appendElement(b, 4, result.Actions[i].marshalProto())
+	}
+	if result.Controller.Hostname != "" {
+		b = appendElement(b, 5, appendStringField(nil, 1, result.Controller.Hostname))
+	}
+	return b
+}
+
+func (result *ClientResult) unmarshalProto(data []byte) error {
+	*result = ClientResult{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			result.ID = string(data)
+		case field == 2 && wire == wireBytes:
+			result.Name = string(data)
+		case field == 3 && wire == wireBytes:
+			result.JID = string(data)
+		case field == 4 && wire == wireBytes:
+			var action ActionResult
+			if err := action.unmarshalProto(data); err != nil {
+				return err
+			}
+			result.Actions = append(result.Actions, action)
+		case field == 5 && wire == wireBytes:
+			return eachField(data, func(field, wire, value uint64, data []byte) error {
+				if field == 1 && wire == wireBytes {
+					result.Controller.Hostname = string(data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func (chunk *OutputChunk) marshalProto() []byte {
+	b := appendStringField(nil, 1, chunk.ID)
+	b = appendStringField(b, 2, chunk.Name)
+	b = appendStringField(b, 3, chunk.JID)
+	b = appendIntField(b, 4, chunk.Index)
+	b = appendStringField(b, 5, chunk.Stream)
+	b = appendIntField(b, 6, chunk.Seq)
+	return appendStringField(b, 7, chunk.Data)
+}
+
+func (chunk *OutputChunk) unmarshalProto(data []byte) error {
+	*chunk = OutputChunk{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			chunk.ID = string(data)
+		case field == 2 && wire == wireBytes:
+			chunk.Name = string(data)
+		case field == 3 && wire == wireBytes:
+			chunk.JID = string(data)
+		case field == 4 && wire == wireVarint:
+			chunk.Index = int(int64(value))
+		case field == 5 && wire == wireBytes:
+			chunk.Stream = string(data)
+		case field == 6 && wire == wireVarint:
+			chunk.Seq = int(int64(value))
+		case field == 7 && wire == wireBytes:
+			chunk.Data = string(data)
+		}
+		return nil
+	})
+}
+
+func (facts *Facts) marshalProto() []byte {
+	b := appendStringField(nil, 1, facts.ID)
+	b = appendStringField(b, 2, facts.Name)
+	b = appendStringMap(b, 3, facts.Labels)
+	return appendStringMap(b, 4, facts.Facts)
+}
+
+func (facts *Facts) unmarshalProto(data []byte) error {
+	*facts = Facts{}
+	return eachField(data, func(field, wire, value uint64, data []byte) (err error) {
+		switch {
+		case field == 1 && wire == wireBytes:
+			facts.ID = string(data)
+		case field == 2 && wire == wireBytes:
+			facts.Name = string(data)
+		case field == 3 && wire == wireBytes:
+			facts.Labels, err = readMapEntry(facts.Labels, data)
+		case field == 4 && wire == wireBytes:
+			facts.Facts, err = readMapEntry(facts.Facts, data)
+		}
+		return err
+	})
+}
+
+func (hello *Hello) marshalProto() []byte {
+	b := appendIntField(nil, 1, hello.MinVersion)
+	b = appendIntField(b, 2, hello.MaxVersion)
+	b = appendStringField(b, 3, hello.BuildVersion)
+	b = appendStrings(b, 4, hello.Codecs)
+	b = appendStrings(b, 5, hello.Compression)
+	b = appendStrings(b, 6, hello.Modules)
+	return appendVarintField(b, 7, uint64(hello.HeartbeatInterval))
+}
+
+func (hello *Hello) unmarshalProto(data []byte) error {
+	*hello = Hello{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			hello.MinVersion = int(int64(value))
+		case field == 2 && wire == wireVarint:
+			hello.MaxVersion = int(int64(value))
+		case field == 3 && wire == wireBytes:
+			hello.BuildVersion = string(data)
+		case field == 4 && wire == wireBytes:
+			hello.Codecs = append(hello.Codecs, string(data))
+		case field == 5 && wire == wireBytes:
+			hello.Compression = append(hello.Compression, string(data))
+		case field == 6 && wire == wireBytes:
+			hello.Modules = append(hello.Modules, string(data))
+		case field == 7 && wire == wireVarint:
+			hello.HeartbeatInterval = time.Duration(value)
+		}
+		return nil
+	})
+}
+
+func (ack *HelloAck) marshalProto() []byte {
+	b := appendIntField(nil, 1, ack.Version)
+	b = appendStringField(b, 2, ack.BuildVersion)
+	b = appendStringField(b, 3, ack.Codec)
+	b = appendStringField(b, 4, ack.Compression)
+	b = appendStrings(b, 5, ack.Modules)
+	return appendVarintField(b, 6, uint64(ack.HeartbeatInterval))
+}
+
+func (ack *HelloAck) unmarshalProto(data []byte) error {
+	*ack = HelloAck{}
+	return eachField(data, func(field, wire, value uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			ack.Version = int(int64(value))
+		case field == 2 && wire == wireBytes:
+			ack.BuildVersion = string(data)
+		case field == 3 && wire == wireBytes:
+			ack.Codec = string(data)
+		case field == 4 && wire == wireBytes:
+			ack.Compression = string(data)
+		case field == 5 && wire == wireBytes:
+			ack.Modules = append(ack.Modules, string(data))
+		case field == 6 && wire == wireVarint:
+			ack.HeartbeatInterval = time.Duration(value)
+		}
+		return nil
+	})
+}
+
+func appendStringField(b []byte, field int, value string) []byte {
+	return appendBytesField(b, field, []byte(value))
+}
+
+//int64 fields, negative values take ten bytes like they do in protobuf
+func appendIntField(b []byte, field int, value int) []byte {
+	return appendVarintField(b, field, uint64(int64(value)))
+}
+
+func appendStrings(b []byte, field int, values []string) []byte {
+	for _, value := range values {
+		b = appendElement(b, field, []byte(value))
+	}
+	return b
+}
+
+//map<string, string> is a repeated entry message, written in key order so encodings are stable
+func appendStringMap(b []byte, field int, values map[string]string) []byte {
+	for _, key := range SortedKeys(values) {
+		entry := appendStringField(nil, 1, key)
+		entry = appendStringField(entry, 2, values[key])
+		b = appendElement(b, field, entry)
+	}
+	return b
+}
+
+func readMapEntry(values map[string]string, entry []byte) (map[string]string, error) {
+	var key, value string
+	err := eachField(entry, func(field, wire, _ uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			key = string(data)
+		case field == 2 && wire == wireBytes:
+			value = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return values, err
+	}
+	if values == nil {
+		values = make(map[string]string)
+	}
+	values[key] = value
+	return values, nil
+}
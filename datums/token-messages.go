@@ -0,0 +1,60 @@
+package datums
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TokenActionCreate = "create"
+	TokenActionList   = "list"
+	TokenActionDelete = "delete"
+)
+
+//TokenReq asks the server to create, list or delete bootstrap tokens
+type TokenReq struct {
+	Action string
+	ID     string
+	TTL    time.Duration
+	Uses   int
+	Labels map[string]string
+}
+
+//TokenEntry describes a bootstrap token without its secret
+type TokenEntry struct {
+	ID      string
+	Expires time.Time
+	Uses    int
+	Labels  map[string]string
+}
+
+//TokenResult is returned by the server for a TokenReq, Secret is only set on create
+type TokenResult struct {
+	Tokens []TokenEntry
+	Secret string
+	Error  string
+}
+
+//ParseLabels reads labels in the form key=value,key=value
+func ParseLabels(labels string) map[string]string {
+	parsed := make(map[string]string)
+	for _, label := range strings.Split(labels, ",") {
+		keyAndValue := strings.SplitN(strings.TrimSpace(label), "=", 2)
+		if len(keyAndValue) != 2 || keyAndValue[0] == "" {
+			continue
+		}
+		parsed[keyAndValue[0]] = keyAndValue[1]
+	}
+	return parsed
+}
+
+//FormatLabels writes labels in the form key=value,key=value sorted by key
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
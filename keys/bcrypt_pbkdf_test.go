@@ -0,0 +1,45 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+//Vectors from the OpenBSD bcrypt_pbkdf regression tests
+func TestBcryptPBKDFKnownAnswers(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		rounds         int
+		want           string
+	}{
+		{"password", "salt", 4, "5bbf0cc293587f1c3635555c27796598d47e579071bf427e9d8fbe842aba34d9"},
+		{"password\x00", "salt\x00", 4, "7410e44cf4fa07bfaac8a928b1727fac001375e7bf7384370f48efd121743050"},
+		{"password", "salt", 8, "e1367ec5151a33faac4cc1c144cd23fa15d5548493ecc99b9b5d9c0d3b27bec76227ea66088b849b20ab7aa478010246e74bba51723fefa9f9474d6508845e8d"},
+	}
+	for _, test := range tests {
+		want, _ := hex.DecodeString(test.want)
+		got, err := bcryptPBKDF([]byte(test.password), []byte(test.salt), test.rounds, len(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q/%q/%d: got %x, want %x", test.password, test.salt, test.rounds, got, want)
+		}
+	}
+}
+
+func TestBcryptPBKDFRejectsBadParameters(t *testing.T) {
+	if _, err := bcryptPBKDF([]byte("password"), []byte("salt"), 0, 32); err == nil {
+		t.Error("zero rounds were accepted")
+	}
+	if _, err := bcryptPBKDF([]byte("password"), nil, 4, 32); err == nil {
+		t.Error("empty salt was accepted")
+	}
+	if _, err := bcryptPBKDF(nil, []byte("salt"), 4, 32); err == nil {
+		t.Error("empty passphrase was accepted")
+	}
+	if _, err := bcryptPBKDF([]byte("password"), []byte("salt"), 4, 1025); err == nil {
+		t.Error("oversize key was accepted")
+	}
+}
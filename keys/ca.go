@@ -0,0 +1,69 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//Allow for clock skew between the CA and the server
+const certBackdate = 5 * time.Minute
+
+//SignUserCert issues a user certificate for a minion key signed by the CA
+func SignUserCert(ca ssh.Signer, pub ssh.PublicKey, id string, principals []string, validFor time.Duration) (*ssh.Certificate, error) {
+	if len(principals) == 0 {
+		return nil, errors.New("at least one principal is required")
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           id,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-certBackdate).Unix()),
+		ValidBefore:     uint64(now.Add(validFor).Unix()),
+	}
+	if validFor <= 0 {
+		cert.ValidBefore = ssh.CertTimeInfinity
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+//ReadPublicKey loads a public key or certificate in authorized_keys format
+func ReadPublicKey(file string) (ssh.PublicKey, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buffer)
+	return pub, err
+}
+
+//CertSigner pairs the certificate in certFile with its private key, it returns nil if there is no certificate
+func CertSigner(certFile string, signer ssh.Signer) (ssh.Signer, error) {
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+	pub, err := ReadPublicKey(certFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New(certFile + " is not a certificate")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
@@ -1,20 +1,71 @@
 package keys
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 )
 
-//MakeSSHKeyPair creats a pair of ssh keys
-func MakeSSHKeyPair(pubKeyPath, privateKeyPath string) error {
+//KeyType selects the algorithm used for generated keys
+type KeyType string
+
+const (
+	ED25519   KeyType = "ed25519"
+	ECDSAP256 KeyType = "ecdsa-p256"
+	RSA4096   KeyType = "rsa-4096"
+)
+
+//KeyTypes lists every supported key type, most preferred first
+var KeyTypes = []KeyType{ED25519, ECDSAP256, RSA4096}
+
+//ParseKeyType validates a key type name
+func ParseKeyType(name string) (KeyType, error) {
+	for _, keyType := range KeyTypes {
+		if string(keyType) == name {
+			return keyType, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %q", name)
+}
+
+//FileName is the conventional OpenSSH name for the private key file
+func (keyType KeyType) FileName() string {
+	switch keyType {
+	case ECDSAP256:
+		return "id_ecdsa"
+	case RSA4096:
+		return "id_rsa"
+	default:
+		return "id_ed25519"
+	}
+}
+
+//Algorithm is the SSH public key algorithm for the key type
+func (keyType KeyType) Algorithm() string {
+	switch keyType {
+	case ECDSAP256:
+		return ssh.KeyAlgoECDSA256
+	case RSA4096:
+		return ssh.KeyAlgoRSA
+	default:
+		return ssh.KeyAlgoED25519
+	}
+}
+
+//MakeSSHKeyPair creats a pair of ssh keys, the private key is encrypted if a passphrase is given
+func MakeSSHKeyPair(pubKeyPath, privateKeyPath string, keyType KeyType, passphrase []byte) error {
 	exist, err := checkIfKeysExist(pubKeyPath, privateKeyPath)
 	if err != nil {
 		return err
@@ -22,28 +73,49 @@ func MakeSSHKeyPair(pubKeyPath, privateKeyPath string) error {
 	if exist {
 		return nil
 	}
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := generateKey(keyType)
 	if err != nil {
 		return err
 	}
 
-	// generate and write private key as PEM
-	privateKeyFile, err := os.Create(privateKeyPath)
+	// generate and write private key in OpenSSH format
+	privateKeyFile, err := os.OpenFile(privateKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
 	defer privateKeyFile.Close()
+	//checkIfKeysExist may have already created the file with the default mode
+	if err := privateKeyFile.Chmod(0600); err != nil {
+		return err
+	}
+	privateKeyPEM, err := marshalOpenSSHPrivateKey(privateKey, "hansel", passphrase)
 	if err != nil {
 		return err
 	}
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
 	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
 		return err
 	}
 
 	// generate and write public key
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	signer, err := ssh.NewSignerFromKey(privateKey)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(pub), 0655)
+	return ioutil.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0655)
+}
+
+func generateKey(keyType KeyType) (crypto.PrivateKey, error) {
+	switch keyType {
+	case ED25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
 }
 
 func checkIfKeysExist(pubKeyPath, privateKeyPath string) (bool, error) {
@@ -85,27 +157,45 @@ func checkIfKeysExist(pubKeyPath, privateKeyPath string) (bool, error) {
 }
 
 //PublicKeyFile Load the public/private key pair
-func PublicKeyFile(file string) (ssh.AuthMethod, error) {
-	buffer, err := ioutil.ReadFile(file)
+func PublicKeyFile(file string, unlocker *Unlocker) (ssh.AuthMethod, error) {
+	key, err := unlocker.Signer(file)
 	if err != nil {
 		return nil, err
 	}
+	return ssh.PublicKeys(key), nil
+}
 
-	key, err := ssh.ParsePrivateKey(buffer)
+func PrivateKeySigner(file string, unlocker *Unlocker) (*ssh.Signer, error) {
+	key, err := unlocker.Signer(file)
 	if err != nil {
 		return nil, err
 	}
-	return ssh.PublicKeys(key), nil
+	return &key, nil
 }
 
-func PrivateKeySigner(file string) (*ssh.Signer, error) {
-	buffer, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, err
+//ParsePrivateKey loads OpenSSH format keys of any supported type as well as the PEM formats ssh understands
+func ParsePrivateKey(buffer []byte) (ssh.Signer, error) {
+	return ParsePrivateKeyWithPassphrase(buffer, nil)
+}
+
+//ParsePrivateKeyWithPassphrase loads a private key, decrypting it with the passphrase if it is encrypted
+func ParsePrivateKeyWithPassphrase(buffer, passphrase []byte) (ssh.Signer, error) {
+	block, _ := pem.Decode(buffer)
+	if block == nil {
+		return nil, errors.New("keys: no key found")
 	}
-	key, err := ssh.ParsePrivateKey(buffer)
+	if block.Type != openSSHPEMType {
+		if !x509.IsEncryptedPEMBlock(block) {
+			return ssh.ParsePrivateKey(buffer)
+		}
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(buffer, passphrase)
+	}
+	key, err := parseOpenSSHPrivateKey(block.Bytes, passphrase)
 	if err != nil {
 		return nil, err
 	}
-	return &key, nil
+	return ssh.NewSignerFromKey(key)
 }
@@ -0,0 +1,330 @@
+package keys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+//The OpenSSH private key format is described at
+//https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+const (
+	openSSHMagic     = "openssh-key-v1\x00"
+	openSSHPEMType   = "OPENSSH PRIVATE KEY"
+	openSSHBlockSize = 8
+	openSSHCipher    = "aes256-ctr"
+	openSSHKdf       = "bcrypt"
+	openSSHKdfRounds = 16
+	openSSHSaltSize  = 16
+)
+
+var (
+	//ErrPassphraseRequired is returned when parsing an encrypted key without a passphrase
+	ErrPassphraseRequired = errors.New("keys: private key is encrypted")
+	//ErrIncorrectPassphrase is returned when an encrypted key doesn't decrypt cleanly
+	ErrIncorrectPassphrase = errors.New("keys: incorrect passphrase")
+)
+
+type openSSHKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+type openSSHKdfOpts struct {
+	Salt   []byte
+	Rounds uint32
+}
+
+type openSSHPrivateSection struct {
+	Check1  uint32
+	Check2  uint32
+	Keytype string
+	Rest    []byte `ssh:"rest"`
+}
+
+type openSSHRSAKey struct {
+	N       *big.Int
+	E       *big.Int
+	D       *big.Int
+	Iqmp    *big.Int
+	P       *big.Int
+	Q       *big.Int
+	Comment string
+	Pad     []byte `ssh:"rest"`
+}
+
+type openSSHECDSAKey struct {
+	Curve   string
+	Pub     []byte
+	D       *big.Int
+	Comment string
+	Pad     []byte `ssh:"rest"`
+}
+
+type openSSHEd25519Key struct {
+	Pub     []byte
+	Priv    []byte
+	Comment string
+	Pad     []byte `ssh:"rest"`
+}
+
+//marshalOpenSSHPrivateKey encodes a private key in the format written by ssh-keygen, the key is
+//encrypted with aes256-ctr and bcrypt_pbkdf like ssh-keygen does when a passphrase is given
+func marshalOpenSSHPrivateKey(key crypto.PrivateKey, comment string, passphrase []byte) (*pem.Block, error) {
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check[:])
+
+	var (
+		pub  ssh.PublicKey
+		body []byte
+		err  error
+	)
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pub, err = ssh.NewPublicKey(&k.PublicKey)
+		body = ssh.Marshal(openSSHRSAKey{
+			N:       k.N,
+			E:       big.NewInt(int64(k.E)),
+			D:       k.D,
+			Iqmp:    k.Precomputed.Qinv,
+			P:       k.Primes[0],
+			Q:       k.Primes[1],
+			Comment: comment,
+		})
+	case *ecdsa.PrivateKey:
+		pub, err = ssh.NewPublicKey(&k.PublicKey)
+		body = ssh.Marshal(openSSHECDSAKey{
+			Curve:   curveName(k.Curve),
+			Pub:     elliptic.Marshal(k.Curve, k.X, k.Y),
+			D:       k.D,
+			Comment: comment,
+		})
+	case ed25519.PrivateKey:
+		pub, err = ssh.NewPublicKey(k.Public())
+		body = ssh.Marshal(openSSHEd25519Key{
+			Pub:     []byte(k[ed25519.SeedSize:]),
+			Priv:    []byte(k),
+			Comment: comment,
+		})
+	default:
+		return nil, errors.New("keys: unsupported key type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	section := ssh.Marshal(openSSHPrivateSection{
+		Check1:  checkInt,
+		Check2:  checkInt,
+		Keytype: pub.Type(),
+		Rest:    body,
+	})
+	wrapper := openSSHKey{
+		CipherName: "none",
+		KdfName:    "none",
+		KdfOpts:    "",
+		NumKeys:    1,
+		PubKey:     pub.Marshal(),
+	}
+	blockSize := openSSHBlockSize
+	if len(passphrase) > 0 {
+		blockSize = aes.BlockSize
+	}
+	//The private section is padded out to the cipher block size even when unencrypted
+	for i := 1; len(section)%blockSize != 0; i++ {
+		section = append(section, byte(i))
+	}
+	if len(passphrase) > 0 {
+		salt := make([]byte, openSSHSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		opts := openSSHKdfOpts{Salt: salt, Rounds: openSSHKdfRounds}
+		stream, err := openSSHStream(passphrase, opts)
+		if err != nil {
+			return nil, err
+		}
+		stream.XORKeyStream(section, section)
+		wrapper.CipherName = openSSHCipher
+		wrapper.KdfName = openSSHKdf
+		wrapper.KdfOpts = string(ssh.Marshal(opts))
+	}
+	wrapper.PrivKeyBlock = section
+	return &pem.Block{
+		Type:  openSSHPEMType,
+		Bytes: append([]byte(openSSHMagic), ssh.Marshal(wrapper)...),
+	}, nil
+}
+
+//parseOpenSSHPrivateKey decodes an OpenSSH private key of any supported type, the passphrase is
+//only used if the key is encrypted
+func parseOpenSSHPrivateKey(data, passphrase []byte) (crypto.PrivateKey, error) {
+	wrapper, err := unmarshalOpenSSHKey(data)
+	if err != nil {
+		return nil, err
+	}
+	block := wrapper.PrivKeyBlock
+	switch {
+	case wrapper.CipherName == "none" && wrapper.KdfName == "none":
+	case wrapper.CipherName == openSSHCipher && wrapper.KdfName == openSSHKdf:
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		var opts openSSHKdfOpts
+		if err := ssh.Unmarshal([]byte(wrapper.KdfOpts), &opts); err != nil {
+			return nil, err
+		}
+		stream, err := openSSHStream(passphrase, opts)
+		if err != nil {
+			return nil, err
+		}
+		block = make([]byte, len(wrapper.PrivKeyBlock))
+		stream.XORKeyStream(block, wrapper.PrivKeyBlock)
+		//The check ints are the only way to tell a wrong passphrase from a corrupt key
+		if len(block) < 8 || !bytes.Equal(block[:4], block[4:8]) {
+			return nil, ErrIncorrectPassphrase
+		}
+	default:
+		return nil, errors.New("keys: unsupported cipher " + wrapper.CipherName)
+	}
+	var section openSSHPrivateSection
+	if err := ssh.Unmarshal(block, &section); err != nil {
+		return nil, err
+	}
+	if section.Check1 != section.Check2 {
+		return nil, errors.New("keys: checkint mismatch")
+	}
+
+	switch section.Keytype {
+	case ssh.KeyAlgoRSA:
+		var k openSSHRSAKey
+		if err := ssh.Unmarshal(section.Rest, &k); err != nil {
+			return nil, err
+		}
+		if err := checkPadding(k.Pad); err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: k.N, E: int(k.E.Int64())},
+			D:         k.D,
+			Primes:    []*big.Int{k.P, k.Q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var k openSSHECDSAKey
+		if err := ssh.Unmarshal(section.Rest, &k); err != nil {
+			return nil, err
+		}
+		if err := checkPadding(k.Pad); err != nil {
+			return nil, err
+		}
+		curve := curveByName(k.Curve)
+		if curve == nil {
+			return nil, errors.New("keys: unsupported curve " + k.Curve)
+		}
+		x, y := elliptic.Unmarshal(curve, k.Pub)
+		if x == nil {
+			return nil, errors.New("keys: invalid ecdsa public point")
+		}
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         k.D,
+		}, nil
+	case ssh.KeyAlgoED25519:
+		var k openSSHEd25519Key
+		if err := ssh.Unmarshal(section.Rest, &k); err != nil {
+			return nil, err
+		}
+		if err := checkPadding(k.Pad); err != nil {
+			return nil, err
+		}
+		if len(k.Priv) != ed25519.PrivateKeySize {
+			return nil, errors.New("keys: private key unexpected length")
+		}
+		key := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
+		copy(key, k.Priv)
+		return key, nil
+	default:
+		return nil, errors.New("keys: unhandled key type " + section.Keytype)
+	}
+}
+
+func unmarshalOpenSSHKey(data []byte) (*openSSHKey, error) {
+	if len(data) < len(openSSHMagic) || string(data[:len(openSSHMagic)]) != openSSHMagic {
+		return nil, errors.New("keys: invalid openssh private key format")
+	}
+	var wrapper openSSHKey
+	if err := ssh.Unmarshal(data[len(openSSHMagic):], &wrapper); err != nil {
+		return nil, err
+	}
+	return &wrapper, nil
+}
+
+//openSSHStream derives the aes256-ctr key and iv from the passphrase
+func openSSHStream(passphrase []byte, opts openSSHKdfOpts) (cipher.Stream, error) {
+	k, err := bcryptPBKDF(passphrase, opts.Salt, int(opts.Rounds), 32+aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k[:32])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, k[32:]), nil
+}
+
+func checkPadding(pad []byte) error {
+	for i, b := range pad {
+		if int(b) != i+1 {
+			return errors.New("keys: padding not as expected")
+		}
+	}
+	return nil
+}
+
+func curveName(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P384():
+		return "nistp384"
+	case elliptic.P521():
+		return "nistp521"
+	default:
+		return "nistp256"
+	}
+}
+
+func curveByName(name string) elliptic.Curve {
+	switch name {
+	case "nistp256":
+		return elliptic.P256()
+	case "nistp384":
+		return elliptic.P384()
+	case "nistp521":
+		return elliptic.P521()
+	default:
+		return nil
+	}
+}
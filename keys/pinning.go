@@ -0,0 +1,118 @@
+package keys
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//ErrHostKeyMismatch is returned when a server presents a key other than the one pinned for it
+var ErrHostKeyMismatch = errors.New("host key does not match pinned fingerprint")
+
+//PinnedKey is a host key fingerprint trusted for a server along with its algorithm
+type PinnedKey struct {
+	Fingerprint string
+	Type        string
+}
+
+//PinnedHostKeyCallback returns a HostKeyCallback that trusts the first key a server presents and
+//records it in pinFile, any other key is refused after that unless it has been pinned too.  If
+//fingerprint is set the first key must match it.
+func PinnedHostKeyCallback(pinFile, fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		sha := ssh.FingerprintSHA256(key)
+		pinned, err := PinnedKeys(pinFile, hostname)
+		if err != nil {
+			return err
+		}
+		for _, existing := range pinned {
+			if existing.Fingerprint == sha {
+				return nil
+			}
+		}
+		//Keys announced by the master during a rotation are pinned alongside the original
+		if sha != fingerprint && (len(pinned) > 0 || fingerprint != "") {
+			return fmt.Errorf("%v: %s presented %s", ErrHostKeyMismatch, hostname, sha)
+		}
+		log.Printf("Pinning host key for %s: %s", hostname, sha)
+		return PinKey(pinFile, hostname, PinnedKey{Fingerprint: sha, Type: key.Type()})
+	}
+}
+
+//PinnedHostKeyAlgorithms returns the host key algorithms to negotiate with a server.  Once a key
+//is pinned only its algorithm is offered so the server can't pick a different key, until then the
+//preferred algorithm goes first.
+func PinnedHostKeyAlgorithms(pinFile, hostname, preferred string) ([]string, error) {
+	pinned, err := PinnedKeys(pinFile, hostname)
+	if err != nil {
+		return nil, err
+	}
+	var algorithms []string
+	add := func(algorithm string) {
+		for _, existing := range algorithms {
+			if existing == algorithm {
+				return
+			}
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	for _, key := range pinned {
+		add(key.Type)
+	}
+	if len(algorithms) > 0 {
+		return algorithms, nil
+	}
+	add(preferred)
+	for _, keyType := range KeyTypes {
+		add(keyType.Algorithm())
+	}
+	return algorithms, nil
+}
+
+//PinnedKeys returns the keys recorded for a host
+func PinnedKeys(pinFile, hostname string) ([]PinnedKey, error) {
+	file, err := os.Open(pinFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var pinned []PinnedKey
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hostAndKey := strings.SplitN(scanner.Text(), "=", 2)
+		if len(hostAndKey) != 2 || strings.TrimSpace(hostAndKey[0]) != hostname {
+			continue
+		}
+		fields := strings.Fields(hostAndKey[1])
+		if len(fields) == 0 {
+			continue
+		}
+		//Pins written before other key types existed are always RSA
+		key := PinnedKey{Fingerprint: fields[0], Type: ssh.KeyAlgoRSA}
+		if len(fields) > 1 {
+			key.Type = fields[1]
+		}
+		pinned = append(pinned, key)
+	}
+	return pinned, scanner.Err()
+}
+
+//PinKey records a key as trusted for a host
+func PinKey(pinFile, hostname string, key PinnedKey) error {
+	file, err := os.OpenFile(pinFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(hostname + "=" + key.Fingerprint + " " + key.Type + "\n")
+	return err
+}
@@ -0,0 +1,49 @@
+package keys
+
+import (
+	"os"
+)
+
+//rotationProofContext keeps a rotation signature from being replayed as any other kind of signature
+const rotationProofContext = "hansel-key-rotation"
+
+//NextKeyFile is where the replacement for a private key is written while a rotation is in progress,
+//its public key sits next to it with a .pub suffix
+func NextKeyFile(privateKeyPath string) string {
+	return privateKeyPath + ".next"
+}
+
+//RotationProof is the data a new key signs to prove it was generated for this rotation request, it is
+//bound to the SSH session the request came over so it can't be replayed on another connection
+func RotationProof(sessionID, nonce []byte) []byte {
+	data := []byte(rotationProofContext)
+	data = append(data, sessionID...)
+	return append(data, nonce...)
+}
+
+//PromoteKeyPair replaces a key pair with the pair waiting in NextKeyFile.  The current pair is kept
+//with a .old suffix so it can be restored by hand.
+func PromoteKeyPair(pubKeyPath, privateKeyPath string) error {
+	next := NextKeyFile(privateKeyPath)
+	if _, err := os.Stat(next); err != nil {
+		return err
+	}
+	for _, file := range []string{privateKeyPath, pubKeyPath} {
+		os.Remove(file + ".old")
+		if err := os.Link(file, file+".old"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	//Each rename is atomic so the key file is never missing, the private key goes first since it's what gets loaded
+	if err := os.Rename(next, privateKeyPath); err != nil {
+		return err
+	}
+	return os.Rename(next+".pub", pubKeyPath)
+}
+
+//RemoveNextKeyPair throws away a replacement key pair that was never used
+func RemoveNextKeyPair(privateKeyPath string) {
+	next := NextKeyFile(privateKeyPath)
+	os.Remove(next)
+	os.Remove(next + ".pub")
+}
@@ -0,0 +1,227 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//KeyRecord is everything the master knows about a minion and its key
+type KeyRecord struct {
+	ID          string            `json:"id"`
+	Fingerprint string            `json:"fingerprint"`
+	PublicKey   string            `json:"public_key,omitempty"`
+	State       string            `json:"state"`
+	Hostname    string            `json:"hostname,omitempty"`
+	SourceIP    string            `json:"source_ip,omitempty"`
+	FirstSeen   time.Time         `json:"first_seen"`
+	LastSeen    time.Time         `json:"last_seen"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	AcceptedBy  string            `json:"accepted_by,omitempty"`
+	AcceptedAt  time.Time         `json:"accepted_at"`
+	//The build and protocol version the minion last connected with
+	BuildVersion string     `json:"build_version,omitempty"`
+	Protocol     int        `json:"protocol,omitempty"`
+	History      []KeyEvent `json:"history,omitempty"`
+}
+
+//KeyEvent is a single change to a key, the history shows how a key got to its state
+type KeyEvent struct {
+	Time  time.Time `json:"time"`
+	State string    `json:"state"`
+	By    string    `json:"by,omitempty"`
+	Note  string    `json:"note,omitempty"`
+}
+
+//AddEvent moves the record to a state and appends it to the history
+func (record *KeyRecord) AddEvent(state, by, note string) {
+	record.State = state
+	record.History = append(record.History, KeyEvent{
+		Time:  time.Now(),
+		State: state,
+		By:    by,
+		Note:  note,
+	})
+}
+
+func (record *KeyRecord) clone() *KeyRecord {
+	clone := *record
+	if record.Labels != nil {
+		clone.Labels = make(map[string]string, len(record.Labels))
+		for k, v := range record.Labels {
+			clone.Labels[k] = v
+		}
+	}
+	clone.History = append([]KeyEvent(nil), record.History...)
+	return &clone
+}
+
+//Key is what the record is stored under, the minion ID or the fingerprint for a key revoked before
+//its minion was known
+func (record *KeyRecord) Key() string {
+	if record.ID != "" {
+		return record.ID
+	}
+	return record.Fingerprint
+}
+
+//Store keeps every minion in a single JSON file indexed by minion ID and fingerprint, reads are
+//served from memory and every change rewrites the file
+type Store struct {
+	sync.RWMutex
+	path          string
+	records       map[string]*KeyRecord
+	byFingerprint map[string]*KeyRecord
+}
+
+//OpenStore loads the store at path, a missing file is an empty store
+func OpenStore(path string) (*Store, error) {
+	store := &Store{
+		path:          path,
+		records:       make(map[string]*KeyRecord),
+		byFingerprint: make(map[string]*KeyRecord),
+	}
+	buffer, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(buffer)) == 0 {
+		return store, nil
+	}
+	var list []*KeyRecord
+	if err := json.Unmarshal(buffer, &list); err != nil {
+		return nil, err
+	}
+	records := make(map[string]*KeyRecord, len(list))
+	for _, record := range list {
+		records[record.Key()] = record
+	}
+	store.records, store.byFingerprint, err = index(records)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+//Get returns a copy of the record for a minion ID
+func (store *Store) Get(id string) (KeyRecord, bool) {
+	store.RLock()
+	defer store.RUnlock()
+	record, ok := store.records[id]
+	if !ok {
+		return KeyRecord{}, false
+	}
+	return *record.clone(), true
+}
+
+//GetByFingerprint returns a copy of the record holding a key
+func (store *Store) GetByFingerprint(fingerprint string) (KeyRecord, bool) {
+	store.RLock()
+	defer store.RUnlock()
+	record, ok := store.byFingerprint[fingerprint]
+	if !ok {
+		return KeyRecord{}, false
+	}
+	return *record.clone(), true
+}
+
+//List returns a copy of every record ordered by minion ID
+func (store *Store) List() []KeyRecord {
+	store.RLock()
+	defer store.RUnlock()
+	records := make([]KeyRecord, 0, len(store.records))
+	for _, record := range store.records {
+		records = append(records, *record.clone())
+	}
+	sortRecords(records)
+	return records
+}
+
+//Update hands fn a copy of the records indexed by Key and saves whatever it leaves behind.  Nothing
+//changes if fn returns an error, leaves two records with the same key or the store can't be written.
+func (store *Store) Update(fn func(records map[string]*KeyRecord) error) error {
+	store.Lock()
+	defer store.Unlock()
+	records := make(map[string]*KeyRecord, len(store.records))
+	for key, record := range store.records {
+		records[key] = record.clone()
+	}
+	if err := fn(records); err != nil {
+		return err
+	}
+	indexed, byFingerprint, err := index(records)
+	if err != nil {
+		return err
+	}
+	list := make([]KeyRecord, 0, len(indexed))
+	for _, record := range indexed {
+		list = append(list, *record)
+	}
+	sortRecords(list)
+	buffer, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(store.path, buffer); err != nil {
+		return err
+	}
+	store.records = indexed
+	store.byFingerprint = byFingerprint
+	return nil
+}
+
+//Rebuild both indexes, a record may have been changed without being moved to its new key
+func index(records map[string]*KeyRecord) (map[string]*KeyRecord, map[string]*KeyRecord, error) {
+	byKey := make(map[string]*KeyRecord, len(records))
+	byFingerprint := make(map[string]*KeyRecord, len(records))
+	for _, record := range records {
+		if existing, ok := byKey[record.Key()]; ok {
+			return nil, nil, fmt.Errorf("keys: %s is recorded twice", existing.Key())
+		}
+		if existing, ok := byFingerprint[record.Fingerprint]; ok {
+			return nil, nil, fmt.Errorf("keys: %s is held by both %s and %s", record.Fingerprint, existing.Key(), record.Key())
+		}
+		byKey[record.Key()] = record
+		byFingerprint[record.Fingerprint] = record
+	}
+	return byKey, byFingerprint, nil
+}
+
+func sortRecords(records []KeyRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key() < records[j].Key()
+	})
+}
+
+//WriteFileAtomic replaces a file by writing a temp file and renaming it over the original
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
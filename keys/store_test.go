@@ -0,0 +1,112 @@
+package keys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempStore(t *testing.T) (*Store, string, func()) {
+	dir, err := ioutil.TempDir("", "hansel-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys.json")
+	store, err := OpenStore(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, path, func() { os.RemoveAll(dir) }
+}
+
+func TestStoreSavesAndReloads(t *testing.T) {
+	store, path, cleanup := tempStore(t)
+	defer cleanup()
+	err := store.Update(func(records map[string]*KeyRecord) error {
+		record := &KeyRecord{ID: "web-1", Fingerprint: "SHA256:web", Labels: map[string]string{"role": "web"}}
+		record.AddEvent("authorized", "admin", "")
+		records[record.Key()] = record
+		//Revoked before its minion was known, kept under the fingerprint
+		records["SHA256:old"] = &KeyRecord{Fingerprint: "SHA256:old", State: "revoked"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := reopened.Get("web-1")
+	if !ok || record.State != "authorized" || record.Labels["role"] != "web" || len(record.History) != 1 {
+		t.Fatalf("got %+v", record)
+	}
+	if record, ok := reopened.GetByFingerprint("SHA256:old"); !ok || record.Key() != "SHA256:old" {
+		t.Fatalf("fingerprint only record: %+v", record)
+	}
+	if list := reopened.List(); len(list) != 2 || list[0].Key() != "SHA256:old" {
+		t.Fatalf("list: %+v", list)
+	}
+}
+
+func TestStoreRefusesDuplicateFingerprints(t *testing.T) {
+	store, path, cleanup := tempStore(t)
+	defer cleanup()
+	err := store.Update(func(records map[string]*KeyRecord) error {
+		records["a"] = &KeyRecord{ID: "a", Fingerprint: "SHA256:same"}
+		records["b"] = &KeyRecord{ID: "b", Fingerprint: "SHA256:same"}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("two minions were given the same key")
+	}
+	if len(store.List()) != 0 {
+		t.Fatal("failed update changed the store")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("failed update wrote the file")
+	}
+}
+
+func TestStoreCopiesRecords(t *testing.T) {
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+	err := store.Update(func(records map[string]*KeyRecord) error {
+		records["a"] = &KeyRecord{ID: "a", Fingerprint: "SHA256:a", Labels: map[string]string{"role": "web"}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ := store.Get("a")
+	record.Labels["role"] = "db"
+	//Changes only count when Update succeeds
+	store.Update(func(records map[string]*KeyRecord) error {
+		records["a"].Labels["role"] = "cache"
+		return os.ErrInvalid
+	})
+	if record, _ := store.Get("a"); record.Labels["role"] != "web" {
+		t.Fatalf("stored record changed to %q", record.Labels["role"])
+	}
+}
+
+func TestOpenStoreEmptyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.List()) != 0 {
+		t.Fatal("empty file has records")
+	}
+}
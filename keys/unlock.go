@@ -0,0 +1,203 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+//Unlocker holds the ways an encrypted private key can be unlocked.  They are tried in order, a
+//matching key held by a running ssh-agent, then the passphrase file, then the environment variable.
+type Unlocker struct {
+	AgentSocket    string
+	PassphraseFile string
+	PassphraseEnv  string
+
+	//The agent is dialed the first time it is needed and kept, signers it hands out sign through it
+	mu        sync.Mutex
+	agentConn net.Conn
+	agent     agent.Agent
+}
+
+//Passphrase returns the configured passphrase, or nil if there isn't one
+func (unlocker *Unlocker) Passphrase() ([]byte, error) {
+	if unlocker == nil {
+		return nil, nil
+	}
+	if unlocker.PassphraseFile != "" {
+		buffer, err := ioutil.ReadFile(unlocker.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(buffer, "\r\n"), nil
+	}
+	if unlocker.PassphraseEnv != "" {
+		if passphrase := os.Getenv(unlocker.PassphraseEnv); passphrase != "" {
+			return []byte(passphrase), nil
+		}
+	}
+	return nil, nil
+}
+
+//Signer loads a private key from a file, unlocking it if it is encrypted
+func (unlocker *Unlocker) Signer(file string) (ssh.Signer, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ParsePrivateKey(buffer)
+	if err != ErrPassphraseRequired {
+		return signer, err
+	}
+	pub, err := encryptedPublicKey(buffer, file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err = unlocker.agentSigner(pub)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		return signer, nil
+	}
+	passphrase, err := unlocker.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == nil {
+		return nil, fmt.Errorf("%s is encrypted, provide a passphrase or load it into ssh-agent", file)
+	}
+	return ParsePrivateKeyWithPassphrase(buffer, passphrase)
+}
+
+//agentSigner returns a signer for the key if the agent holds it
+func (unlocker *Unlocker) agentSigner(pub ssh.PublicKey) (ssh.Signer, error) {
+	signer, from, err := unlocker.agentKey(pub)
+	if signer == nil || err != nil {
+		return nil, err
+	}
+	return &agentKeySigner{unlocker: unlocker, pub: pub, signer: signer, from: from}, nil
+}
+
+//agentKey looks the key up in the agent, dialing it if there is no connection, and returns the agent
+//the signer came from along with it
+func (unlocker *Unlocker) agentKey(pub ssh.PublicKey) (ssh.Signer, agent.Agent, error) {
+	if unlocker == nil || unlocker.AgentSocket == "" {
+		return nil, nil, nil
+	}
+	unlocker.mu.Lock()
+	defer unlocker.mu.Unlock()
+	if unlocker.agent == nil {
+		conn, err := net.Dial("unix", unlocker.AgentSocket)
+		if err != nil {
+			return nil, nil, err
+		}
+		unlocker.agentConn = conn
+		unlocker.agent = agent.NewClient(conn)
+	}
+	signers, err := unlocker.agent.Signers()
+	if err != nil {
+		//The agent may have restarted, dial it again next time
+		unlocker.closeAgent()
+		return nil, nil, err
+	}
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+			return signer, unlocker.agent, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+//Hang up on an agent that failed, unless another signer already dialed it again
+func (unlocker *Unlocker) dropAgent(from agent.Agent) {
+	unlocker.mu.Lock()
+	defer unlocker.mu.Unlock()
+	if unlocker.agent == from {
+		unlocker.closeAgent()
+	}
+}
+
+//agentKeySigner signs through the agent and survives the agent restarting: when signing fails the
+//agent is dialed again and the signature is tried once more
+type agentKeySigner struct {
+	unlocker *Unlocker
+	pub      ssh.PublicKey
+
+	mu     sync.Mutex
+	signer ssh.Signer
+	from   agent.Agent
+}
+
+func (signer *agentKeySigner) PublicKey() ssh.PublicKey {
+	return signer.pub
+}
+
+func (signer *agentKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer.mu.Lock()
+	current, from := signer.signer, signer.from
+	signer.mu.Unlock()
+	sig, err := current.Sign(rand, data)
+	if err == nil {
+		return sig, nil
+	}
+	signer.unlocker.dropAgent(from)
+	fresh, from, lookupErr := signer.unlocker.agentKey(signer.pub)
+	if lookupErr != nil {
+		return nil, fmt.Errorf("%v, dialing ssh-agent again: %v", err, lookupErr)
+	}
+	if fresh == nil {
+		return nil, fmt.Errorf("%v, ssh-agent no longer holds %s", err, ssh.FingerprintSHA256(signer.pub))
+	}
+	signer.mu.Lock()
+	signer.signer, signer.from = fresh, from
+	signer.mu.Unlock()
+	return fresh.Sign(rand, data)
+}
+
+//Close hangs up on the agent, signers it handed out dial it again the next time they sign
+func (unlocker *Unlocker) Close() error {
+	if unlocker == nil {
+		return nil
+	}
+	unlocker.mu.Lock()
+	defer unlocker.mu.Unlock()
+	return unlocker.closeAgent()
+}
+
+func (unlocker *Unlocker) closeAgent() error {
+	if unlocker.agentConn == nil {
+		return nil
+	}
+	err := unlocker.agentConn.Close()
+	unlocker.agentConn = nil
+	unlocker.agent = nil
+	return err
+}
+
+//encryptedPublicKey finds the public half of an encrypted key, OpenSSH keys carry it unencrypted
+//and for anything else it is read from the .pub file next to the key
+func encryptedPublicKey(buffer []byte, file string) (ssh.PublicKey, error) {
+	block, _ := pem.Decode(buffer)
+	if block != nil && block.Type == openSSHPEMType {
+		wrapper, err := unmarshalOpenSSHKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePublicKey(wrapper.PubKey)
+	}
+	pubBuffer, err := ioutil.ReadFile(file + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBuffer)
+	return pub, err
+}
@@ -0,0 +1,176 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+//Serve a keyring over a unix socket and count the connections made to it, stop hangs up on every
+//connection like an agent that exits
+func serveAgent(t *testing.T, dir string, keyring agent.Agent) (net.Listener, *int32, func()) {
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dials int32
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	stop := func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	return listener, &dials, stop
+}
+
+//Write the key encrypted so it can only be unlocked through the agent
+func writeEncryptedKey(t *testing.T, dir string, key ed25519.PrivateKey) string {
+	block, err := marshalOpenSSHPrivateKey(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestUnlockerReusesTheAgentConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-unlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: &key}); err != nil {
+		t.Fatal(err)
+	}
+	listener, dials, stop := serveAgent(t, dir, keyring)
+	defer stop()
+	file := writeEncryptedKey(t, dir, key)
+
+	unlocker := &Unlocker{AgentSocket: listener.Addr().String()}
+	defer unlocker.Close()
+	for i := 0; i < 3; i++ {
+		signer, err := unlocker.Signer(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := signer.Sign(rand.Reader, []byte("hansel")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Fatalf("dialed the agent %d times", n)
+	}
+}
+
+func TestUnlockerFallsBackToThePassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-unlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The agent is running but doesn't hold the key
+	listener, _, stop := serveAgent(t, dir, agent.NewKeyring())
+	defer stop()
+	file := writeEncryptedKey(t, dir, key)
+	passFile := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(passFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	unlocker := &Unlocker{AgentSocket: listener.Addr().String()}
+	defer unlocker.Close()
+	if _, err := unlocker.Signer(file); err == nil {
+		t.Fatal("unlocked without a passphrase")
+	}
+	unlocker.PassphraseFile = passFile
+	if _, err := unlocker.Signer(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgentSignerSurvivesAgentRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hansel-unlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: &key}); err != nil {
+		t.Fatal(err)
+	}
+	listener, _, stop := serveAgent(t, dir, keyring)
+	file := writeEncryptedKey(t, dir, key)
+	unlocker := &Unlocker{AgentSocket: listener.Addr().String()}
+	defer unlocker.Close()
+	signer, err := unlocker.Signer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The agent exits and a new one comes up on the same socket holding the same key
+	stop()
+	os.Remove(listener.Addr().String())
+	_, dials, stop := serveAgent(t, dir, keyring)
+	defer func() { stop() }()
+	sig, err := signer.Sign(rand.Reader, []byte("hansel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.PublicKey().Verify([]byte("hansel"), sig); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Fatalf("dialed the new agent %d times", n)
+	}
+
+	//An agent that lost the key fails after the one retry
+	stop()
+	os.Remove(listener.Addr().String())
+	_, _, stop = serveAgent(t, dir, agent.NewKeyring())
+	if _, err := signer.Sign(rand.Reader, []byte("hansel")); err == nil {
+		t.Fatal("signed with a key the agent doesn't hold")
+	}
+}
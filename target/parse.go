@@ -0,0 +1,261 @@
+package target
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//GroupFunc looks up the expression a named node group stands for
+type GroupFunc func(name string) (string, bool)
+
+//ErrUnknownGroup is returned when an expression names a node group that isn't defined
+var ErrUnknownGroup = errors.New("unknown node group")
+
+//Parse reads a compound expression.  Words are joined with and, or and not, not binds tightest and or
+//loosest, and parentheses group words.  A word is one of:
+//
+//	web-*            glob on the minion ID or hostname
+//	E@db[0-9]+       regular expression on the minion ID or hostname
+//	L@web-1,db-*     list of minion IDs or hostnames, each one can be a glob
+//	I@role=web       label with a value matching the glob, I@role matches any value
+//	G@host.os:linux  fact with a value matching the glob, key=value works too
+//	N@webfleet       node group, expanded with groups
+//	S@10.0.0.0/8     address the minion connects from
+func Parse(expr string, groups GroupFunc) (Expr, error) {
+	return parse(expr, groups, nil)
+}
+
+//Groups being expanded are kept on a stack so a group that includes itself is caught
+func parse(expr string, groups GroupFunc, expanding []string) (Expr, error) {
+	parser := &parser{
+		tokens:    tokenize(expr),
+		groups:    groups,
+		expanding: expanding,
+	}
+	if len(parser.tokens) == 0 {
+		return nil, errors.New("empty target expression")
+	}
+	result, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if token, ok := parser.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q in target expression", token)
+	}
+	return result, nil
+}
+
+//Split an expression into words, operators and parentheses.  Parentheses only need spaces around them
+//where a word would otherwise swallow them: a ) that closes one opened inside the word, like the one in
+//E@db(1|2), stays part of the word.  An operator right before a ( is split off, so not(web-1) works.
+func tokenize(expr string) []string {
+	var tokens []string
+	for _, field := range strings.Fields(expr) {
+		for {
+			if strings.HasPrefix(field, "(") {
+				tokens = append(tokens, "(")
+				field = field[1:]
+				continue
+			}
+			operator := leadingOperator(field)
+			if operator == "" {
+				break
+			}
+			tokens = append(tokens, field[:len(operator)])
+			field = field[len(operator):]
+		}
+		closing := 0
+		for strings.HasSuffix(field, ")") && strings.Count(field, ")") > strings.Count(field, "(") {
+			field = field[:len(field)-1]
+			closing++
+		}
+		if field != "" {
+			tokens = append(tokens, field)
+		}
+		for ; closing > 0; closing-- {
+			tokens = append(tokens, ")")
+		}
+	}
+	return tokens
+}
+
+//The operator a field starts with when a ( follows it straight away
+func leadingOperator(field string) string {
+	for _, operator := range []string{"not", "and", "or"} {
+		if len(field) > len(operator) && strings.EqualFold(field[:len(operator)], operator) && field[len(operator)] == '(' {
+			return operator
+		}
+	}
+	return ""
+}
+
+type parser struct {
+	tokens    []string
+	pos       int
+	groups    GroupFunc
+	expanding []string
+}
+
+func (parser *parser) peek() (string, bool) {
+	if parser.pos >= len(parser.tokens) {
+		return "", false
+	}
+	return parser.tokens[parser.pos], true
+}
+
+func (parser *parser) next() (string, bool) {
+	token, ok := parser.peek()
+	if ok {
+		parser.pos++
+	}
+	return token, ok
+}
+
+//Consume the next token if it is the operator
+func (parser *parser) accept(operator string) bool {
+	token, ok := parser.peek()
+	if ok && strings.EqualFold(token, operator) {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *parser) or() (Expr, error) {
+	var exprs []Expr
+	for {
+		expr, err := parser.and()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !parser.accept("or") {
+			return Or(exprs...), nil
+		}
+	}
+}
+
+func (parser *parser) and() (Expr, error) {
+	var exprs []Expr
+	for {
+		expr, err := parser.not()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !parser.accept("and") {
+			return And(exprs...), nil
+		}
+	}
+}
+
+func (parser *parser) not() (Expr, error) {
+	if parser.accept("not") {
+		expr, err := parser.not()
+		if err != nil {
+			return nil, err
+		}
+		return Not(expr), nil
+	}
+	if parser.accept("(") {
+		expr, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		if !parser.accept(")") {
+			return nil, errors.New("missing ) in target expression")
+		}
+		return expr, nil
+	}
+	token, ok := parser.next()
+	if !ok {
+		return nil, errors.New("target expression ends early")
+	}
+	switch strings.ToLower(token) {
+	case "and", "or", ")":
+		return nil, fmt.Errorf("unexpected %q in target expression", token)
+	}
+	return parser.word(token)
+}
+
+//Turn a single word into the expression its prefix calls for
+func (parser *parser) word(token string) (Expr, error) {
+	if len(token) < 2 || token[1] != '@' {
+		return Glob(token)
+	}
+	value := token[2:]
+	if value == "" {
+		return nil, fmt.Errorf("nothing after %q in target expression", token)
+	}
+	switch token[0] {
+	case 'E':
+		return Regex(value)
+	case 'L':
+		return hostList(value)
+	case 'I':
+		key, glob := splitPair(value, "=")
+		return Label(key, glob)
+	case 'G':
+		key, glob := splitPair(value, "=", ":")
+		if glob == "" {
+			return nil, fmt.Errorf("fact %q needs a value", value)
+		}
+		return Fact(key, glob)
+	case 'N':
+		return parser.group(value)
+	case 'S':
+		return Subnet(value)
+	}
+	return nil, fmt.Errorf("unknown target type %q", token[:2])
+}
+
+//Expand a node group in place
+func (parser *parser) group(name string) (Expr, error) {
+	for _, expanding := range parser.expanding {
+		if expanding == name {
+			return nil, fmt.Errorf("node group %s includes itself", name)
+		}
+	}
+	if parser.groups == nil {
+		return nil, fmt.Errorf("%v %s", ErrUnknownGroup, name)
+	}
+	expr, ok := parser.groups(name)
+	if !ok {
+		return nil, fmt.Errorf("%v %s", ErrUnknownGroup, name)
+	}
+	expanded, err := parse(expr, parser.groups, append(parser.expanding[:len(parser.expanding):len(parser.expanding)], name))
+	if err != nil {
+		return nil, fmt.Errorf("node group %s: %v", name, err)
+	}
+	return expanded, nil
+}
+
+//A comma separated list of IDs or hostnames, matched as globs
+func hostList(value string) (Expr, error) {
+	var exprs []Expr
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		glob, err := Glob(name)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, glob)
+	}
+	if len(exprs) == 0 {
+		return nil, fmt.Errorf("empty host list %q in target expression", value)
+	}
+	return Or(exprs...), nil
+}
+
+//Split key and value on the first separator found, the value is empty when there is none
+func splitPair(pair string, separators ...string) (string, string) {
+	for _, sep := range separators {
+		if i := strings.Index(pair, sep); i >= 0 {
+			return pair[:i], pair[i+len(sep):]
+		}
+	}
+	return pair, ""
+}
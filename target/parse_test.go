@@ -0,0 +1,228 @@
+package target
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var minions = []*Minion{
+	{ID: "web-1", Name: "web1.example.com", IP: net.ParseIP("10.0.0.1"), Labels: map[string]string{"role": "web", "env": "prod"}, Facts: map[string]string{"host.os": "linux"}},
+	{ID: "web-2", Name: "web2.example.com", IP: net.ParseIP("10.0.0.2"), Labels: map[string]string{"role": "web", "env": "staging"}, Facts: map[string]string{"host.os": "linux"}},
+	{ID: "db-1", Name: "db1.example.com", IP: net.ParseIP("10.1.0.1"), Labels: map[string]string{"role": "db", "env": "prod"}, Facts: map[string]string{"host.os": "freebsd"}},
+	{ID: "db-2", Name: "db2.example.com", IP: net.ParseIP("192.168.1.5"), Facts: map[string]string{"host.os": "linux"}},
+}
+
+var testGroups = map[string]string{
+	"webfleet": "I@role=web",
+	"prod":     "I@env=prod",
+	"prodweb":  "N@webfleet and N@prod",
+	"loop":     "N@loop2",
+	"loop2":    "web-* or N@loop",
+	"self":     "N@self",
+	"broken":   "E@(",
+}
+
+func lookup(name string) (string, bool) {
+	expr, ok := testGroups[name]
+	return expr, ok
+}
+
+//IDs of the test minions an expression matches
+func matching(t *testing.T, expr string) []string {
+	parsed, err := Parse(expr, lookup)
+	if err != nil {
+		t.Fatalf("%q: %v", expr, err)
+	}
+	var ids []string
+	for _, minion := range minions {
+		if parsed.Match(minion) {
+			ids = append(ids, minion.ID)
+		}
+	}
+	return ids
+}
+
+func TestParseMatches(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"web-*", []string{"web-1", "web-2"}},
+		{"*.example.com", []string{"web-1", "web-2", "db-1", "db-2"}},
+		{"E@^db-[0-9]+$", []string{"db-1", "db-2"}},
+		{"E@db(1|2)", []string{"db-1", "db-2"}},
+		{"I@role=web", []string{"web-1", "web-2"}},
+		{"I@role", []string{"web-1", "web-2", "db-1"}},
+		{"I@env=pro*", []string{"web-1", "db-1"}},
+		{"G@host.os:linux", []string{"web-1", "web-2", "db-2"}},
+		{"G@host.os=freebsd", []string{"db-1"}},
+		{"S@10.0.0.0/16", []string{"web-1", "web-2"}},
+		{"S@192.168.1.5", []string{"db-2"}},
+		{"N@webfleet", []string{"web-1", "web-2"}},
+		{"N@prodweb", []string{"web-1"}},
+		{"not web-*", []string{"db-1", "db-2"}},
+		{"NOT I@role AND G@host.os=linux", []string{"db-2"}},
+		{"not not db-1", []string{"db-1"}},
+		{"L@web-1,db-*", []string{"web-1", "db-1", "db-2"}},
+		{"L@db2.example.com", []string{"db-2"}},
+		{"not(web-1)", []string{"web-2", "db-1", "db-2"}},
+		{"NOT(web-*) and(I@role)", []string{"db-1"}},
+	}
+	for _, test := range tests {
+		if got := matching(t, test.expr); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q matched %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		//and binds tighter than or
+		{"db-1 or web-* and I@env=staging", []string{"web-2", "db-1"}},
+		{"( db-1 or web-* ) and I@env=staging", []string{"web-2"}},
+		//not binds tighter than and
+		{"not web-1 and I@role", []string{"web-2", "db-1"}},
+		{"not ( web-1 and I@role )", []string{"web-2", "db-1", "db-2"}},
+	}
+	for _, test := range tests {
+		if got := matching(t, test.expr); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q matched %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestParseParenthesesWithoutSpaces(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"(db-1 or db-2)", []string{"db-1", "db-2"}},
+		{"(db-1 or web-*) and I@env=staging", []string{"web-2"}},
+		{"not (web-1 or (db-1))", []string{"web-2", "db-2"}},
+		{"((web-1))", []string{"web-1"}},
+		{"(E@db(1|2) or web-1)", []string{"web-1", "db-1", "db-2"}},
+	}
+	for _, test := range tests {
+		if got := matching(t, test.expr); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q matched %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := map[string][]string{
+		"(a or b)":           {"(", "a", "or", "b", ")"},
+		"((a)) and not (b)":  {"(", "(", "a", ")", ")", "and", "not", "(", "b", ")"},
+		"E@x(1|2)":           {"E@x(1|2)"},
+		"(E@x(1|2))":         {"(", "E@x(1|2)", ")"},
+		"  a   and\tb ":      {"a", "and", "b"},
+		"( a )":              {"(", "a", ")"},
+		"I@role=web) or (db": {"I@role=web", ")", "or", "(", "db"},
+	}
+	for expr, want := range tests {
+		if got := tokenize(expr); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q gave %q, want %q", expr, got, want)
+		}
+	}
+}
+
+//The example the compound targeting was asked for with: role is a fact the minions report here
+func TestParseRequestExample(t *testing.T) {
+	expr, err := Parse("G@role:web and not L@web-canary-* or E@db[0-9]+", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		minion *Minion
+		want   bool
+	}{
+		{&Minion{ID: "web-1", Facts: map[string]string{"role": "web"}}, true},
+		{&Minion{ID: "web-canary-1", Facts: map[string]string{"role": "web"}}, false},
+		{&Minion{ID: "db12"}, true},
+		{&Minion{ID: "web-canary-db1", Facts: map[string]string{"role": "web"}}, true},
+		{&Minion{ID: "cache-1", Facts: map[string]string{"role": "cache"}}, false},
+	}
+	for _, test := range tests {
+		if got := expr.Match(test.minion); got != test.want {
+			t.Errorf("%s: matched %v, want %v", test.minion.ID, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"":                "empty target expression",
+		"   ":             "empty target expression",
+		"web-1 and":       "ends early",
+		"or web-1":        `unexpected "or"`,
+		"web-1 web-2":     `unexpected "web-2"`,
+		"(web-1 or web-2": "missing )",
+		"web-1)":          `unexpected ")"`,
+		"E@(":             "missing closing )",
+		"X@thing":         "unknown target type",
+		"I@":              "nothing after",
+		"L@,":             "empty host list",
+		"G@host.os":       "needs a value",
+		"S@nonsense":      "bad address",
+		"N@missing":       ErrUnknownGroup.Error(),
+		"N@broken":        "node group broken",
+		"[":               "bad glob",
+	}
+	for expr, want := range tests {
+		_, err := Parse(expr, lookup)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gave %v, want an error containing %q", expr, err, want)
+		}
+	}
+}
+
+func TestParseGroupCycles(t *testing.T) {
+	for _, name := range []string{"self", "loop", "loop2"} {
+		_, err := Parse("N@"+name, lookup)
+		if err == nil || !strings.Contains(err.Error(), "includes itself") {
+			t.Errorf("N@%s gave %v", name, err)
+		}
+	}
+	//A group used twice side by side isn't a cycle
+	if _, err := Parse("N@webfleet or N@webfleet", lookup); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseWithoutGroups(t *testing.T) {
+	if _, err := Parse("N@webfleet", nil); err == nil || !strings.Contains(err.Error(), ErrUnknownGroup.Error()) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestStringParsesBack(t *testing.T) {
+	exprs := []string{
+		"web-1 or db-* and not I@role=web",
+		"(E@db(1|2) or S@10.0.0.0/8) and G@host.os=linux",
+		"I@role and not ( web-1 or web-2 )",
+		"L@web-1,db-* and not(I@env=prod)",
+	}
+	for _, expr := range exprs {
+		parsed, err := Parse(expr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := Parse(parsed.String(), nil)
+		if err != nil {
+			t.Fatalf("%q printed as %q: %v", expr, parsed.String(), err)
+		}
+		if again.String() != parsed.String() {
+			t.Errorf("%q printed as %q then %q", expr, parsed.String(), again.String())
+		}
+		for _, minion := range minions {
+			if again.Match(minion) != parsed.Match(minion) {
+				t.Errorf("%q and %q disagree on %s", expr, parsed.String(), minion.ID)
+			}
+		}
+	}
+}
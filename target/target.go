@@ -0,0 +1,237 @@
+package target
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//Minion is what a target is matched against
+type Minion struct {
+	ID     string
+	Name   string
+	IP     net.IP
+	Labels map[string]string
+	Facts  map[string]string
+}
+
+//Expr decides whether a minion is targeted, String gives it back in the expression syntax
+type Expr interface {
+	Match(minion *Minion) bool
+	String() string
+}
+
+//Glob matches the minion ID or hostname with a shell glob
+func Glob(pattern string) (Expr, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad glob %q: %v", pattern, err)
+	}
+	return globExpr(pattern), nil
+}
+
+type globExpr string
+
+func (expr globExpr) Match(minion *Minion) bool {
+	return globMatch(string(expr), minion.ID) || globMatch(string(expr), minion.Name)
+}
+
+func (expr globExpr) String() string {
+	return string(expr)
+}
+
+//Regex matches the minion ID or hostname with a regular expression, it isn't anchored
+func Regex(pattern string) (Expr, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return regexExpr{re}, nil
+}
+
+type regexExpr struct {
+	re *regexp.Regexp
+}
+
+func (expr regexExpr) Match(minion *Minion) bool {
+	return expr.re.MatchString(minion.ID) || expr.re.MatchString(minion.Name)
+}
+
+func (expr regexExpr) String() string {
+	return "E@" + expr.re.String()
+}
+
+//List matches minions whose ID or hostname is one of the names exactly
+func List(names ...string) Expr {
+	return listExpr(names)
+}
+
+type listExpr []string
+
+func (expr listExpr) Match(minion *Minion) bool {
+	for _, name := range expr {
+		if name == minion.ID || name == minion.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (expr listExpr) String() string {
+	return "( " + strings.Join(expr, " or ") + " )"
+}
+
+//Label matches minions with a label whose value matches the glob, any value matches when it is empty
+func Label(key, value string) (Expr, error) {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return nil, fmt.Errorf("bad glob %q for label %s: %v", value, key, err)
+	}
+	return labelExpr{key, value}, nil
+}
+
+type labelExpr struct {
+	key, value string
+}
+
+func (expr labelExpr) Match(minion *Minion) bool {
+	value, ok := minion.Labels[expr.key]
+	return ok && (expr.value == "" || globMatch(expr.value, value))
+}
+
+func (expr labelExpr) String() string {
+	if expr.value == "" {
+		return "I@" + expr.key
+	}
+	return "I@" + expr.key + "=" + expr.value
+}
+
+//Fact matches minions with a fact whose value matches the glob
+func Fact(key, value string) (Expr, error) {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return nil, fmt.Errorf("bad glob %q for fact %s: %v", value, key, err)
+	}
+	return factExpr{key, value}, nil
+}
+
+type factExpr struct {
+	key, value string
+}
+
+func (expr factExpr) Match(minion *Minion) bool {
+	value, ok := minion.Facts[expr.key]
+	return ok && globMatch(expr.value, value)
+}
+
+func (expr factExpr) String() string {
+	return "G@" + expr.key + "=" + expr.value
+}
+
+//Subnet matches minions connecting from an address in the CIDR, a bare address matches only itself
+func Subnet(cidr string) (Expr, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("bad address %q", cidr)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		cidr = fmt.Sprintf("%s/%d", cidr, bits)
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return subnetExpr{network}, nil
+}
+
+type subnetExpr struct {
+	network *net.IPNet
+}
+
+func (expr subnetExpr) Match(minion *Minion) bool {
+	return minion.IP != nil && expr.network.Contains(minion.IP)
+}
+
+func (expr subnetExpr) String() string {
+	return "S@" + expr.network.String()
+}
+
+//And matches minions every expression matches
+func And(exprs ...Expr) Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return andExpr(exprs)
+}
+
+type andExpr []Expr
+
+func (expr andExpr) Match(minion *Minion) bool {
+	for _, child := range expr {
+		if !child.Match(minion) {
+			return false
+		}
+	}
+	return true
+}
+
+func (expr andExpr) String() string {
+	return joinExprs(expr, " and ")
+}
+
+//Or matches minions any of the expressions match
+func Or(exprs ...Expr) Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return orExpr(exprs)
+}
+
+type orExpr []Expr
+
+func (expr orExpr) Match(minion *Minion) bool {
+	for _, child := range expr {
+		if child.Match(minion) {
+			return true
+		}
+	}
+	return false
+}
+
+func (expr orExpr) String() string {
+	return joinExprs(expr, " or ")
+}
+
+//Not matches minions the expression doesn't
+func Not(expr Expr) Expr {
+	return notExpr{expr}
+}
+
+type notExpr struct {
+	expr Expr
+}
+
+func (expr notExpr) Match(minion *Minion) bool {
+	return !expr.expr.Match(minion)
+}
+
+func (expr notExpr) String() string {
+	return "not " + expr.expr.String()
+}
+
+//Every expression is wrapped in parentheses so the string parses back to the same thing
+func joinExprs(exprs []Expr, sep string) string {
+	parts := make([]string, len(exprs))
+	for i, expr := range exprs {
+		parts[i] = expr.String()
+	}
+	return "( " + strings.Join(parts, sep) + " )"
+}
+
+func globMatch(pattern, name string) bool {
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
@@ -0,0 +1,73 @@
+package target
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListMatchesExactly(t *testing.T) {
+	list := List("web-1", "db2.example.com")
+	for _, minion := range minions {
+		want := minion.ID == "web-1" || minion.ID == "db-2"
+		if list.Match(minion) != want {
+			t.Errorf("%s: matched %v, want %v", minion.ID, !want, want)
+		}
+	}
+	if List().Match(minions[0]) {
+		t.Error("an empty list matched")
+	}
+}
+
+func TestSubnetNeedsAnAddress(t *testing.T) {
+	subnet, err := Subnet("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnet.Match(&Minion{ID: "unix"}) {
+		t.Error("minion without an address matched")
+	}
+	v6, err := Subnet("fd00::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v6.Match(&Minion{IP: net.ParseIP("fd00::1")}) || v6.Match(&Minion{IP: net.ParseIP("fd00::2")}) {
+		t.Error("a bare IPv6 address should match only itself")
+	}
+}
+
+func TestLabelAndFactNeedTheKey(t *testing.T) {
+	label, err := Label("role", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fact, err := Fact("host.os", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := &Minion{ID: "bare"}
+	if label.Match(bare) || fact.Match(bare) {
+		t.Error("matched a minion without labels or facts")
+	}
+	if _, err := Label("role", "["); err == nil {
+		t.Error("bad label glob was accepted")
+	}
+	if _, err := Fact("host.os", "["); err == nil {
+		t.Error("bad fact glob was accepted")
+	}
+}
+
+func TestAndOrOfOne(t *testing.T) {
+	glob, err := Glob("web-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if And(glob) != glob || Or(glob) != glob {
+		t.Error("a single expression should not be wrapped")
+	}
+	if !And().Match(minions[0]) {
+		t.Error("and of nothing should match everything")
+	}
+	if Or().Match(minions[0]) {
+		t.Error("or of nothing should match nothing")
+	}
+}